@@ -18,6 +18,7 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/gartnera/gcloud/helpers"
 	"github.com/kirsle/configdir"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -150,11 +151,7 @@ func (m *ApplicationCredentialManager) discoverAcPath() string {
 	}
 	acPath := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
 	if acPath == "" {
-		defaultConfigDir := os.Getenv("CLOUDSDK_CONFIG")
-		if defaultConfigDir == "" {
-			// TODO: cross platform
-			defaultConfigDir = os.ExpandEnv("${HOME}/.config/gcloud")
-		}
+		defaultConfigDir := helpers.ConfigDir()
 		// don't worry about this error, this is best effort anyway
 		_ = os.MkdirAll(defaultConfigDir, os.ModeDir)
 		acPath = path.Join(defaultConfigDir, "application_default_credentials.json")
@@ -1,68 +1,291 @@
 package auth
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 
 	"github.com/docker/cli/cli/config/configfile"
+	"github.com/pmezard/go-difflib/difflib"
 	"github.com/spf13/cobra"
 )
 
+const dockerHelperName = "gcloud"
+const dockerHelperUsername = "_dcgcloud_token"
+
+// errCredentialsNotFound is the magic error message docker uses to detect missing credentials
+var errCredentialsNotFound = errors.New("credentials not found in native keychain")
+
+// dockerConfigPath returns the docker config.json path respecting DOCKER_CONFIG
+func dockerConfigPath() string {
+	configDir := os.Getenv("DOCKER_CONFIG")
+	if configDir == "" {
+		configDir = os.ExpandEnv("${HOME}/.docker")
+	}
+	return filepath.Join(configDir, "config.json")
+}
+
+// containersAuthPath returns the podman/containers auth.json path respecting REGISTRY_AUTH_FILE
+func containersAuthPath() string {
+	authPath := os.Getenv("REGISTRY_AUTH_FILE")
+	if authPath != "" {
+		return authPath
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtime.GOOS == "linux" && runtimeDir != "" {
+		return filepath.Join(runtimeDir, "containers", "auth.json")
+	}
+	return os.ExpandEnv("${HOME}/.config/containers/auth.json")
+}
+
+func serializeDockerConfig(config *configfile.ConfigFile) (string, error) {
+	buf := new(bytes.Buffer)
+	err := config.SaveToWriter(buf)
+	if err != nil {
+		return "", fmt.Errorf("unable to serialize config: %w", err)
+	}
+	return buf.String(), nil
+}
+
+func diffLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return difflib.SplitLines(s)
+}
+
+// parseRegistryArgs accepts registries as multiple args or a comma separated list (like python gcloud)
+func parseRegistryArgs(args []string) []string {
+	var res []string
+	for _, arg := range args {
+		for _, registry := range strings.Split(arg, ",") {
+			registry = strings.TrimSpace(registry)
+			if registry != "" {
+				res = append(res, registry)
+			}
+		}
+	}
+	if len(res) == 0 {
+		return DefaultDockerRegistries()
+	}
+	return res
+}
+
 var configureDockerCmd = &cobra.Command{
-	Use:  "configure-docker",
-	Args: cobra.MinimumNArgs(1),
+	Use:          "configure-docker [REGISTRIES]",
+	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		configPath := os.ExpandEnv("${HOME}/.docker/config.json")
+		remove, _ := cmd.Flags().GetBool("remove")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		useContainers, _ := cmd.Flags().GetBool("containers")
+
+		configPath := dockerConfigPath()
+		if useContainers {
+			configPath = containersAuthPath()
+		}
 		config := configfile.New(configPath)
 
+		before := ""
 		configFile, err := os.Open(configPath)
 		if err == nil {
 			err = config.LoadFromReader(configFile)
 			configFile.Close()
 			if err != nil {
-				return fmt.Errorf("unable to load docker config file: %w", err)
+				return fmt.Errorf("unable to load config file: %w", err)
+			}
+			before, err = serializeDockerConfig(config)
+			if err != nil {
+				return err
 			}
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("unable to open config file: %w", err)
 		}
 		if config.CredentialHelpers == nil {
 			config.CredentialHelpers = make(map[string]string)
 		}
-		for _, hostname := range args {
-			config.CredentialHelpers[hostname] = "gcloud"
+		changed := false
+		for _, hostname := range parseRegistryArgs(args) {
+			owned := config.CredentialHelpers[hostname] == dockerHelperName
+			if !remove && !owned {
+				config.CredentialHelpers[hostname] = dockerHelperName
+				changed = true
+			}
+			// only remove entries that we own
+			if remove && owned {
+				delete(config.CredentialHelpers, hostname)
+				changed = true
+			}
+		}
+		// this also avoids creating a config file just to remove nothing from it
+		if !changed {
+			fmt.Fprintf(cmd.ErrOrStderr(), "%s is already up to date\n", configPath)
+			return nil
+		}
+
+		after, err := serializeDockerConfig(config)
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+				A:        diffLines(before),
+				B:        diffLines(after),
+				FromFile: configPath,
+				ToFile:   configPath,
+				Context:  3,
+			})
+			if err != nil {
+				return fmt.Errorf("unable to diff config: %w", err)
+			}
+			fmt.Fprint(cmd.OutOrStdout(), diff)
+			return nil
 		}
 
 		err = config.Save()
 		if err != nil {
-			return fmt.Errorf("unable to save docker config: %w", err)
+			return fmt.Errorf("unable to save config: %w", err)
 		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Updated %s\n", configPath)
 
 		return nil
 	},
 }
 
+// DockerHelperRes is the response to the get action of the credential helper protocol
 type DockerHelperRes struct {
-	Secret   string
-	Username string
+	ServerURL string `json:",omitempty"`
+	Secret    string
+	Username  string
+}
+
+// dockerHelperStoreReq is the input to the store action of the credential helper protocol
+type dockerHelperStoreReq struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+func readServerURL(in io.Reader) (string, error) {
+	inBytes, err := ioutil.ReadAll(in)
+	if err != nil {
+		return "", fmt.Errorf("unable to read server url: %w", err)
+	}
+	serverURL := strings.TrimSpace(string(inBytes))
+	if serverURL == "" {
+		return "", errors.New("no server url provided")
+	}
+	return serverURL, nil
+}
+
+func dockerHelperGet(cmd *cobra.Command) error {
+	serverURL, err := readServerURL(cmd.InOrStdin())
+	if err != nil {
+		return err
+	}
+	if !isGoogleRegistry(registryHost(serverURL)) {
+		return errCredentialsNotFound
+	}
+	tok, err := Token()
+	if err != nil {
+		return fmt.Errorf("unable to get token: %w", err)
+	}
+
+	res := &DockerHelperRes{
+		ServerURL: serverURL,
+		Secret:    tok.AccessToken,
+		Username:  dockerHelperUsername,
+	}
+
+	encoder := json.NewEncoder(cmd.OutOrStdout())
+	return encoder.Encode(res)
+}
+
+func dockerHelperList(cmd *cobra.Command) error {
+	res := make(map[string]string)
+	for _, registry := range DefaultDockerRegistries() {
+		res["https://"+registry] = dockerHelperUsername
+	}
+	encoder := json.NewEncoder(cmd.OutOrStdout())
+	return encoder.Encode(res)
+}
+
+// dockerHelperStore validates the input but does not persist anything because
+// tokens are always minted from the current gcloud credentials
+func dockerHelperStore(cmd *cobra.Command) error {
+	req := &dockerHelperStoreReq{}
+	err := json.NewDecoder(cmd.InOrStdin()).Decode(req)
+	if err != nil {
+		return fmt.Errorf("unable to decode credentials: %w", err)
+	}
+	if req.ServerURL == "" {
+		return errors.New("no server url provided")
+	}
+	return nil
+}
+
+// dockerHelperErase is a noop for the same reason as dockerHelperStore
+func dockerHelperErase(cmd *cobra.Command) error {
+	_, err := readServerURL(cmd.InOrStdin())
+	return err
+}
+
+func runDockerHelper(cmd *cobra.Command, args []string) error {
+	var err error
+	switch args[0] {
+	case "get":
+		err = dockerHelperGet(cmd)
+	case "list":
+		err = dockerHelperList(cmd)
+	case "store":
+		err = dockerHelperStore(cmd)
+	case "erase":
+		err = dockerHelperErase(cmd)
+	default:
+		// like git, ignore actions added to the protocol later
+		return nil
+	}
+	if err != nil {
+		// docker reads the error message from stdout
+		fmt.Fprintln(cmd.OutOrStdout(), err)
+	}
+	return err
 }
 
 var dockerHelperCmd = &cobra.Command{
-	Use: "docker-helper",
-	RunE: func(cmd *cobra.Command, args []string) error {
-		// ignore all operations except for get
-		if len(args) > 0 && args[0] != "get" {
-			return nil
-		}
-		tok, err := Token()
-		if err != nil {
-			return fmt.Errorf("unable to get token: %w", err)
-		}
+	Use:          "docker-helper get|list|store|erase",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         runDockerHelper,
+}
 
-		res := &DockerHelperRes{
-			Secret:   tok.AccessToken,
-			Username: "_dcgcloud_token",
-		}
+// DockerCredentialHelperName is the name docker uses to invoke the gcloud credential helper
+const DockerCredentialHelperName = "docker-credential-" + dockerHelperName
 
-		encoder := json.NewEncoder(cmd.OutOrStdout())
-		return encoder.Encode(res)
-	},
+var dockerCredentialHelperCmd = &cobra.Command{
+	Use:          DockerCredentialHelperName + " get|list|store|erase",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         runDockerHelper,
+}
+
+// GetDockerCredentialHelperCmd returns a standalone command that behaves like
+// the docker-credential-gcloud binary
+func GetDockerCredentialHelperCmd() *cobra.Command {
+	return dockerCredentialHelperCmd
+}
+
+func registerConfigureDockerCmd(parent *cobra.Command) {
+	fs := configureDockerCmd.Flags()
+	fs.Bool("remove", false, "remove the gcloud credential helper from the registries")
+	fs.Bool("dry-run", false, "print a diff of the config changes without writing them")
+	fs.Bool("containers", false, "configure the podman/containers auth.json (REGISTRY_AUTH_FILE) rather than the docker config.json (DOCKER_CONFIG)")
+	parent.AddCommand(configureDockerCmd)
 }
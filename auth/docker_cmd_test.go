@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryHost(t *testing.T) {
+	tests := map[string]string{
+		"gcr.io":                        "gcr.io",
+		"https://gcr.io":                "gcr.io",
+		"https://us-docker.pkg.dev/v2/": "us-docker.pkg.dev",
+		"US-Central1-Docker.pkg.dev/project/repo": "us-central1-docker.pkg.dev",
+		"gcr.io:443":                         "gcr.io",
+		" https://eu.gcr.io:443/v2/token \n": "eu.gcr.io",
+	}
+	for serverURL, want := range tests {
+		require.Equal(t, want, registryHost(serverURL), serverURL)
+	}
+}
+
+func TestIsGoogleRegistry(t *testing.T) {
+	tests := map[string]bool{
+		"gcr.io":                     true,
+		"us.gcr.io":                  true,
+		"marketplace.gcr.io":         true,
+		"us-central1-docker.pkg.dev": true,
+		"docker.io":                  false,
+		"gcr.io.evil.com":            false,
+		"evilgcr.io":                 false,
+		"docker.pkg.dev.evil.com":    false,
+	}
+	for host, want := range tests {
+		require.Equal(t, want, isGoogleRegistry(host), host)
+	}
+}
+
+func TestParseRegistryArgs(t *testing.T) {
+	require.Equal(t, DefaultDockerRegistries(), parseRegistryArgs(nil))
+	require.Equal(t, DefaultDockerRegistries(), parseRegistryArgs([]string{" , "}))
+	require.Equal(t, []string{"gcr.io", "us-docker.pkg.dev", "eu.gcr.io"}, parseRegistryArgs([]string{"gcr.io, us-docker.pkg.dev", "eu.gcr.io"}))
+}
+
+// runTestDockerHelper runs the docker credential helper action with input on stdin
+func runTestDockerHelper(action string, input string) (string, error) {
+	cmd := &cobra.Command{}
+	stdout := new(bytes.Buffer)
+	cmd.SetIn(strings.NewReader(input))
+	cmd.SetOut(stdout)
+	err := runDockerHelper(cmd, []string{action})
+	return stdout.String(), err
+}
+
+func TestDockerHelper(t *testing.T) {
+	// credentials for other registries are left to other helpers
+	stdout, err := runTestDockerHelper("get", "https://index.docker.io/v1/\n")
+	require.Equal(t, errCredentialsNotFound, err)
+	require.Equal(t, errCredentialsNotFound.Error()+"\n", stdout)
+
+	_, err = runTestDockerHelper("get", "")
+	require.Error(t, err)
+
+	stdout, err = runTestDockerHelper("list", "")
+	require.NoError(t, err)
+	list := map[string]string{}
+	require.NoError(t, json.Unmarshal([]byte(stdout), &list))
+	require.Equal(t, dockerHelperUsername, list["https://gcr.io"])
+	require.Equal(t, dockerHelperUsername, list["https://us-central1-docker.pkg.dev"])
+	require.Len(t, list, len(DefaultDockerRegistries()))
+
+	stdout, err = runTestDockerHelper("store", `{"ServerURL": "https://gcr.io", "Username": "_dcgcloud_token", "Secret": "token"}`)
+	require.NoError(t, err)
+	require.Empty(t, stdout)
+	_, err = runTestDockerHelper("store", `{"Username": "_dcgcloud_token"}`)
+	require.Error(t, err)
+	_, err = runTestDockerHelper("store", "not json")
+	require.Error(t, err)
+
+	stdout, err = runTestDockerHelper("erase", "https://gcr.io\n")
+	require.NoError(t, err)
+	require.Empty(t, stdout)
+
+	// unknown actions are ignored
+	stdout, err = runTestDockerHelper("version", "")
+	require.NoError(t, err)
+	require.Empty(t, stdout)
+}
+
+func TestConfigureDocker(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	configPath := filepath.Join(dir, "config.json")
+	cmd := GetRootCmd()
+	cmd.SetErr(new(bytes.Buffer))
+
+	// removing from a missing config doesn't create it
+	cmd.SetArgs([]string{"configure-docker", "--remove", "gcr.io"})
+	require.NoError(t, cmd.Execute())
+	require.NoFileExists(t, configPath)
+
+	cmd.SetArgs([]string{"configure-docker", "--remove=false", "gcr.io,us-docker.pkg.dev"})
+	require.NoError(t, cmd.Execute())
+	config := map[string]map[string]string{}
+	data, err := os.ReadFile(configPath)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &config))
+	require.Equal(t, map[string]string{"gcr.io": "gcloud", "us-docker.pkg.dev": "gcloud"}, config["credHelpers"])
+
+	cmd.SetArgs([]string{"configure-docker", "--remove", "gcr.io"})
+	require.NoError(t, cmd.Execute())
+	config = map[string]map[string]string{}
+	data, err = os.ReadFile(configPath)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &config))
+	require.Equal(t, map[string]string{"us-docker.pkg.dev": "gcloud"}, config["credHelpers"])
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"net"
+	"strings"
+)
+
+// gcrRegistries are the container registry hosts
+var gcrRegistries = []string{
+	"gcr.io",
+	"us.gcr.io",
+	"eu.gcr.io",
+	"asia.gcr.io",
+	"marketplace.gcr.io",
+}
+
+// artifactRegistryLocations are the artifact registry locations which have a
+// LOCATION-docker.pkg.dev host
+var artifactRegistryLocations = []string{
+	"africa-south1",
+	"asia",
+	"asia-east1",
+	"asia-east2",
+	"asia-northeast1",
+	"asia-northeast2",
+	"asia-northeast3",
+	"asia-south1",
+	"asia-south2",
+	"asia-southeast1",
+	"asia-southeast2",
+	"australia-southeast1",
+	"australia-southeast2",
+	"europe",
+	"europe-central2",
+	"europe-north1",
+	"europe-southwest1",
+	"europe-west1",
+	"europe-west10",
+	"europe-west12",
+	"europe-west2",
+	"europe-west3",
+	"europe-west4",
+	"europe-west6",
+	"europe-west8",
+	"europe-west9",
+	"me-central1",
+	"me-central2",
+	"me-west1",
+	"northamerica-northeast1",
+	"northamerica-northeast2",
+	"southamerica-east1",
+	"southamerica-west1",
+	"us",
+	"us-central1",
+	"us-east1",
+	"us-east4",
+	"us-east5",
+	"us-south1",
+	"us-west1",
+	"us-west2",
+	"us-west3",
+	"us-west4",
+}
+
+// DefaultDockerRegistries returns all of the gcr.io and *-docker.pkg.dev registry hosts
+func DefaultDockerRegistries() []string {
+	res := append([]string{}, gcrRegistries...)
+	for _, location := range artifactRegistryLocations {
+		res = append(res, location+"-docker.pkg.dev")
+	}
+	return res
+}
+
+// registryHost extracts the host from a server url as provided by docker.
+// The url may or may not have a scheme, path, or port.
+func registryHost(serverURL string) string {
+	host := strings.TrimSpace(serverURL)
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// isGoogleRegistry ensures that we only hand out tokens to google registries
+func isGoogleRegistry(host string) bool {
+	if host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") {
+		return true
+	}
+	return strings.HasSuffix(host, "-docker.pkg.dev")
+}
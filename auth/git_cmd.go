@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const gitHelperUsername = "oauth2accesstoken"
+
+// defaultGitHelperURLs are the Cloud Source Repositories and Secure Source Manager url patterns
+var defaultGitHelperURLs = []string{
+	"https://source.developers.google.com",
+	"https://*.*.sourcemanager.dev",
+}
+
+// isGoogleGitHost ensures that we only hand out tokens to google git hosts
+func isGoogleGitHost(host string) bool {
+	// strip the port if present
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	host = strings.ToLower(host)
+	return host == "source.developers.google.com" || strings.HasSuffix(host, ".sourcemanager.dev")
+}
+
+// readGitCredentialAttrs reads the key=value attributes of the git credential helper protocol
+func readGitCredentialAttrs(in io.Reader) (map[string]string, error) {
+	attrs := make(map[string]string)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid credential line: %s", line)
+		}
+		attrs[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read credential attributes: %w", err)
+	}
+	return attrs, nil
+}
+
+var gitHelperCmd = &cobra.Command{
+	Use:          "git-helper get|store|erase",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ignoreUnknown, _ := cmd.Flags().GetBool("ignore-unknown")
+
+		attrs, err := readGitCredentialAttrs(cmd.InOrStdin())
+		if err != nil {
+			return err
+		}
+		switch args[0] {
+		case "get":
+		case "store", "erase":
+			// tokens are always minted from the current gcloud credentials so there is nothing to store
+			return nil
+		default:
+			// helpers must ignore actions they don't understand (see gitcredentials(7))
+			return nil
+		}
+
+		host := attrs["host"]
+		if attrs["protocol"] != "https" || !isGoogleGitHost(host) {
+			if ignoreUnknown {
+				return nil
+			}
+			return fmt.Errorf("unsupported git host: %s://%s", attrs["protocol"], host)
+		}
+
+		tok, err := Token()
+		if err != nil {
+			return fmt.Errorf("unable to get token: %w", err)
+		}
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "username=%s\n", gitHelperUsername)
+		fmt.Fprintf(out, "password=%s\n", tok.AccessToken)
+		if !tok.Expiry.IsZero() {
+			fmt.Fprintf(out, "password_expiry_utc=%d\n", tok.Expiry.Unix())
+		}
+		return nil
+	},
+}
+
+func runGitConfig(cmd *cobra.Command, args ...string) error {
+	gitCmd := exec.Command("git", append([]string{"config"}, args...)...)
+	gitCmd.Stdout = cmd.OutOrStdout()
+	gitCmd.Stderr = cmd.ErrOrStderr()
+	return gitCmd.Run()
+}
+
+var configureGitCmd = &cobra.Command{
+	Use:          "configure-git [URLS]",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		local, _ := cmd.Flags().GetBool("local")
+		scope := "--global"
+		if local {
+			scope = "--local"
+		}
+		urls := args
+		if len(urls) == 0 {
+			urls = defaultGitHelperURLs
+		}
+
+		for _, url := range urls {
+			if !strings.Contains(url, "://") {
+				url = "https://" + url
+			}
+			key := fmt.Sprintf("credential.%s.helper", url)
+			err := runGitConfig(cmd, scope, "--unset-all", key)
+			var exerr *exec.ExitError
+			// exit code 5 means that the key did not exist
+			if err != nil && !(errors.As(err, &exerr) && exerr.ExitCode() == 5) {
+				return fmt.Errorf("unable to unset %s: %w", key, err)
+			}
+			// the empty helper resets any helpers configured for less specific urls
+			err = runGitConfig(cmd, scope, "--add", key, "")
+			if err != nil {
+				return fmt.Errorf("unable to set %s: %w", key, err)
+			}
+			err = runGitConfig(cmd, scope, "--add", key, "!gcloud auth git-helper --ignore-unknown")
+			if err != nil {
+				return fmt.Errorf("unable to set %s: %w", key, err)
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Configured %s\n", key)
+		}
+		return nil
+	},
+}
+
+func registerGitCmds(parent *cobra.Command) {
+	gitHelperCmd.Flags().Bool("ignore-unknown", false, "produce no output and exit successfully for non google hosts")
+	// python gcloud configures the helper with --account, accept it so those configs keep working
+	gitHelperCmd.Flags().String("account", "", "ignored")
+	parent.AddCommand(gitHelperCmd)
+
+	configureGitCmd.Flags().Bool("local", false, "write to the repository config rather than the global config")
+	parent.AddCommand(configureGitCmd)
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsGoogleGitHost(t *testing.T) {
+	tests := map[string]bool{
+		"source.developers.google.com":                  true,
+		"SOURCE.developers.google.com":                  true,
+		"source.developers.google.com:443":              true,
+		"my-instance-123.us-central1.sourcemanager.dev": true,
+		"github.com":                            false,
+		"source.developers.google.com.evil.com": false,
+		"sourcemanager.dev.evil.com":            false,
+		"evilsourcemanager.dev":                 false,
+		"":                                      false,
+	}
+	for host, want := range tests {
+		require.Equal(t, want, isGoogleGitHost(host), host)
+	}
+}
+
+func TestReadGitCredentialAttrs(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{
+			"protocol=https\nhost=source.developers.google.com\npath=p/my-project/r/repo\n",
+			map[string]string{"protocol": "https", "host": "source.developers.google.com", "path": "p/my-project/r/repo"},
+			false,
+		},
+		// values may contain =, and a blank line ends the attributes
+		{"password=a=b\n\nhost=ignored\n", map[string]string{"password": "a=b"}, false},
+		{"protocol=https\nbogus\n", nil, true},
+	}
+	for _, tt := range tests {
+		attrs, err := readGitCredentialAttrs(strings.NewReader(tt.input))
+		if tt.wantErr {
+			require.Error(t, err, tt.input)
+			continue
+		}
+		require.NoError(t, err, tt.input)
+		require.Equal(t, tt.want, attrs, tt.input)
+	}
+}
+
+func TestGitHelperIgnoredActions(t *testing.T) {
+	cmd := GetRootCmd()
+	for _, args := range [][]string{
+		{"git-helper", "store"},
+		{"git-helper", "erase"},
+		// actions added to git later are ignored
+		{"git-helper", "capability"},
+		{"git-helper", "--ignore-unknown", "get"},
+	} {
+		stdout := new(bytes.Buffer)
+		cmd.SetIn(strings.NewReader("protocol=https\nhost=github.com\n\n"))
+		cmd.SetOut(stdout)
+		cmd.SetArgs(args)
+		require.NoError(t, cmd.Execute(), "%v", args)
+		require.Empty(t, stdout.String(), "%v", args)
+	}
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gartnera/gcloud/helpers"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/option"
+	"google.golang.org/api/transport/cert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const useClientCertificateEnv = "GOOGLE_API_USE_CLIENT_CERTIFICATE"
+
+// UseClientCertificate reports if requests should present a device certificate
+// for context aware access. GOOGLE_API_USE_CLIENT_CERTIFICATE takes precedence
+// over the context_aware/use_client_certificate property.
+func UseClientCertificate() bool {
+	value, ok := os.LookupEnv(useClientCertificateEnv)
+	if !ok {
+		value = helpers.GetProperty("context_aware", "use_client_certificate")
+	}
+	use, _ := strconv.ParseBool(value)
+	return use
+}
+
+// ClientCertSource returns the device certificate source. It runs the
+// cert_provider_command from the context_aware/auto_discovery_file_path
+// property, or finds the certificate like the google api clients do
+// (~/.secureConnect/context_aware_metadata.json by default).
+func ClientCertSource() (cert.Source, error) {
+	var source cert.Source
+	var err error
+	if path := helpers.GetProperty("context_aware", "auto_discovery_file_path"); path != "" {
+		source, err = cert.NewSecureConnectSource(path)
+	} else {
+		source, err = cert.DefaultSource()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get client certificate source: %w", err)
+	}
+	if source == nil {
+		return nil, errors.New("client certificates are enabled, but no certificate provider is configured")
+	}
+	return source, nil
+}
+
+// APIEndpoint returns the mTLS variant of a googleapis.com endpoint (like
+// https://container.mtls.googleapis.com/) if client certificates are enabled,
+// or the endpoint as is.
+func APIEndpoint(endpoint string) string {
+	if !UseClientCertificate() || strings.Contains(endpoint, ".mtls.googleapis.com") {
+		return endpoint
+	}
+	return strings.Replace(endpoint, ".googleapis.com", ".mtls.googleapis.com", 1)
+}
+
+// ClientTLSConfig returns the TLS config which presents the device
+// certificate, or nil if client certificates are not enabled
+func ClientTLSConfig() (*tls.Config, error) {
+	if !UseClientCertificate() {
+		return nil, nil
+	}
+	source, err := ClientCertSource()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetClientCertificate: source,
+	}, nil
+}
+
+// ClientOptions returns the options for a google api client of the service at
+// endpoint: a REST base path (https://iap.googleapis.com/) or a gRPC address
+// (container.googleapis.com:443). If client certificates are enabled, the
+// client connects to the mTLS endpoint and presents the device certificate.
+//
+// The clients only pick up a certificate source on their own when
+// GOOGLE_API_USE_CLIENT_CERTIFICATE is set, which would ignore the property,
+// so the transport is set up here instead.
+func ClientOptions(ts oauth2.TokenSource, endpoint string) ([]option.ClientOption, error) {
+	tlsConfig, err := ClientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	endpoint = APIEndpoint(endpoint)
+	if tlsConfig == nil {
+		return []option.ClientOption{
+			option.WithTokenSource(ts),
+			option.WithEndpoint(endpoint),
+		}, nil
+	}
+	if !strings.Contains(endpoint, "://") {
+		return []option.ClientOption{
+			option.WithTokenSource(ts),
+			option.WithEndpoint(endpoint),
+			option.WithGRPCDialOption(grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))),
+		}, nil
+	}
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = tlsConfig
+	client := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: ts,
+			Base:   base,
+		},
+	}
+	return []option.ClientOption{
+		option.WithHTTPClient(client),
+		option.WithEndpoint(endpoint),
+	}, nil
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUseClientCertificate(t *testing.T) {
+	t.Setenv("CLOUDSDK_CONFIG", t.TempDir())
+	tests := []struct {
+		env      *string
+		property string
+		want     bool
+	}{
+		{nil, "", false},
+		{nil, "true", true},
+		{strPtr("true"), "", true},
+		// the env var takes precedence over the property
+		{strPtr("false"), "true", false},
+	}
+	// restore the env var after the test
+	t.Setenv(useClientCertificateEnv, "")
+	for _, tt := range tests {
+		os.Unsetenv(useClientCertificateEnv)
+		if tt.env != nil {
+			t.Setenv(useClientCertificateEnv, *tt.env)
+		}
+		t.Setenv("CLOUDSDK_CONTEXT_AWARE_USE_CLIENT_CERTIFICATE", tt.property)
+		require.Equal(t, tt.want, UseClientCertificate(), "env %v property %q", tt.env, tt.property)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// writeCertProvider writes a self-signed certificate and a secure connect
+// metadata file whose cert_provider_command prints it. It returns the path of
+// the metadata file and the certificate.
+func writeCertProvider(t *testing.T) (string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	pemPath := filepath.Join(dir, "cert.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+	require.NoError(t, os.WriteFile(pemPath, data, 0600))
+
+	metadata, err := json.Marshal(map[string][]string{
+		"cert_provider_command": {"cat", pemPath},
+	})
+	require.NoError(t, err)
+	metadataPath := filepath.Join(dir, "context_aware_metadata.json")
+	require.NoError(t, os.WriteFile(metadataPath, metadata, 0600))
+	return metadataPath, cert
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	t.Setenv("CLOUDSDK_CONFIG", t.TempDir())
+	metadataPath, cert := writeCertProvider(t)
+	t.Setenv("CLOUDSDK_CONTEXT_AWARE_AUTO_DISCOVERY_FILE_PATH", metadataPath)
+
+	t.Setenv(useClientCertificateEnv, "false")
+	config, err := ClientTLSConfig()
+	require.NoError(t, err)
+	require.Nil(t, config)
+
+	t.Setenv(useClientCertificateEnv, "true")
+	config, err = ClientTLSConfig()
+	require.NoError(t, err)
+	require.NotNil(t, config)
+	clientCert, err := config.GetClientCertificate(&tls.CertificateRequestInfo{})
+	require.NoError(t, err)
+	require.Equal(t, cert.Raw, clientCert.Certificate[0])
+}
+
+func TestAPIEndpoint(t *testing.T) {
+	t.Setenv("CLOUDSDK_CONFIG", t.TempDir())
+	tests := []struct {
+		endpoint string
+		enabled  string
+		want     string
+	}{
+		{"https://iap.googleapis.com/", "false", "https://iap.googleapis.com/"},
+		{"https://iap.googleapis.com/", "true", "https://iap.mtls.googleapis.com/"},
+		{"container.googleapis.com:443", "true", "container.mtls.googleapis.com:443"},
+		{"us-central1-connectgateway.googleapis.com", "true", "us-central1-connectgateway.mtls.googleapis.com"},
+		{"https://iap.mtls.googleapis.com/", "true", "https://iap.mtls.googleapis.com/"},
+	}
+	for _, tt := range tests {
+		t.Setenv(useClientCertificateEnv, tt.enabled)
+		require.Equal(t, tt.want, APIEndpoint(tt.endpoint), "endpoint %s enabled %s", tt.endpoint, tt.enabled)
+	}
+}
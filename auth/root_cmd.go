@@ -14,8 +14,9 @@ func GetRootCmd() *cobra.Command {
 		applicationDefaultCmd.AddCommand(applicationDefaultLoginCmd)
 		applicationDefaultCmd.AddCommand(applicationDefaultPrintAccessTokenCmd)
 
-		rootCmd.AddCommand(configureDockerCmd)
+		registerConfigureDockerCmd(rootCmd)
 		rootCmd.AddCommand(dockerHelperCmd)
+		registerGitCmds(rootCmd)
 		rootCmd.AddCommand(loginCmd)
 		rootCmd.AddCommand(autoLoginCmd)
 
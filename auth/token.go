@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/gartnera/gcloud/helpers"
 	"github.com/kirsle/configdir"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -46,12 +47,16 @@ func identityTokenToToken(token *identityToken, isIdentity bool) *oauth2.Token {
 	if isIdentity {
 		accessToken = token.IdToken
 	}
-	return &oauth2.Token{
+	tok := &oauth2.Token{
 		AccessToken:  accessToken,
 		TokenType:    token.TokenType,
 		RefreshToken: token.RefreshToken,
 		Expiry:       token.Expiry,
 	}
+	// expose the id token the same way the oauth2 package does
+	return tok.WithExtra(map[string]interface{}{
+		"id_token": token.IdToken,
+	})
 }
 
 func TokenSourceCtx(ctx context.Context) (*CachingTokenSource, error) {
@@ -82,15 +87,27 @@ func TokenCtx(ctx context.Context) (*oauth2.Token, error) {
 // easily impersonate a service account and maintain the TokenSource interface
 var ImpersonateServiceAccount = ""
 
+// ImpersonatedServiceAccount returns the service account email that will be
+// impersonated or an empty string if impersonation is not active. The
+// --impersonate-service-account flag and the auth/impersonate_service_account
+// property (which kubeconfigs pin per cluster) take precedence over
+// GOOGLE_IMPERSONATE_SERVICE_ACCOUNT.
+func ImpersonatedServiceAccount() string {
+	if ImpersonateServiceAccount != "" {
+		return ImpersonateServiceAccount
+	}
+	if email := helpers.GetProperty("auth", "impersonate_service_account"); email != "" {
+		return email
+	}
+	return os.Getenv("GOOGLE_IMPERSONATE_SERVICE_ACCOUNT")
+}
+
 func maybeGetImpersonatedTokenSource(ctx context.Context) (*CachingTokenSource, error) {
 	mainTs, err := getMainTokenSource(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get main tokensource: %w", err)
 	}
-	email := os.Getenv("GOOGLE_IMPERSONATE_SERVICE_ACCOUNT")
-	if email == "" {
-		email = ImpersonateServiceAccount
-	}
+	email := ImpersonatedServiceAccount()
 	if email != "" {
 		impersonateTs, err := NewGoogleImpersonateTokenSourceWrapper(ctx, email, mainTs)
 		if err != nil {
@@ -134,6 +151,7 @@ type CachingTokenSource struct {
 	lock          *sync.Mutex
 	returnIdToken bool
 	cachePrefix   string
+	minExpiry     time.Duration
 }
 
 func (c *CachingTokenSource) cacheKey() string {
@@ -224,10 +242,31 @@ func (c *CachingTokenSource) Token() (*oauth2.Token, error) {
 	if err != nil {
 		return nil, err
 	}
-	if c.tok != nil && c.tok.Expiry.After(time.Now()) {
+	if c.tok != nil && c.tok.Expiry.After(time.Now().Add(c.minExpiry)) {
 		return identityTokenToToken(c.tok, c.returnIdToken), nil
 	}
+	return c.refresh()
+}
+
+// Refresh ignores any cached token and gets a new token from the underlying token source
+func (c *CachingTokenSource) Refresh() (*oauth2.Token, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.refresh()
+}
+
+// SetMinExpiry ensures that returned tokens will be valid for at least d. Cached tokens
+// which expire sooner are refreshed.
+func (c *CachingTokenSource) SetMinExpiry(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.minExpiry = d
+}
 
+// refresh must be called with the lock held
+func (c *CachingTokenSource) refresh() (*oauth2.Token, error) {
 	tok, err := c.ts.Token()
 	if err != nil {
 		return nil, fmt.Errorf("unable to get token: %w", err)
@@ -250,6 +289,8 @@ func (c *CachingTokenSource) IdentityTokenSource() *CachingTokenSource {
 		tok:           c.tok,
 		lock:          c.lock,
 		returnIdToken: true,
+		cachePrefix:   c.cachePrefix,
+		minExpiry:     c.minExpiry,
 	}
 }
 
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImpersonatedServiceAccount(t *testing.T) {
+	flag := ImpersonateServiceAccount
+	t.Cleanup(func() {
+		ImpersonateServiceAccount = flag
+	})
+	tests := []struct {
+		flag string
+		env  string
+		want string
+	}{
+		{"", "", ""},
+		{"", "env@my-project.iam.gserviceaccount.com", "env@my-project.iam.gserviceaccount.com"},
+		{"flag@my-project.iam.gserviceaccount.com", "", "flag@my-project.iam.gserviceaccount.com"},
+		// the flag pinned in the kubeconfig wins over the environment
+		{"flag@my-project.iam.gserviceaccount.com", "env@my-project.iam.gserviceaccount.com", "flag@my-project.iam.gserviceaccount.com"},
+	}
+	t.Setenv("CLOUDSDK_CONFIG", t.TempDir())
+	t.Setenv("CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT", "")
+	for _, tt := range tests {
+		ImpersonateServiceAccount = tt.flag
+		t.Setenv("GOOGLE_IMPERSONATE_SERVICE_ACCOUNT", tt.env)
+		require.Equal(t, tt.want, ImpersonatedServiceAccount(), "flag %q env %q", tt.flag, tt.env)
+	}
+
+	// kubeconfigs for gke-gcloud-auth-plugin pin the account with the property env
+	ImpersonateServiceAccount = ""
+	t.Setenv("GOOGLE_IMPERSONATE_SERVICE_ACCOUNT", "env@my-project.iam.gserviceaccount.com")
+	t.Setenv("CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT", "property@my-project.iam.gserviceaccount.com")
+	require.Equal(t, "property@my-project.iam.gserviceaccount.com", ImpersonatedServiceAccount())
+}
@@ -0,0 +1,97 @@
+package components
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gartnera/gcloud/auth"
+	"github.com/gartnera/gcloud/config"
+	"github.com/spf13/cobra"
+)
+
+// LinkNames are the plugin names that this binary will emulate when invoked
+// via a link with that name
+var LinkNames = []string{
+	config.GkeAuthPluginName,
+	auth.DockerCredentialHelperName,
+}
+
+func sameFile(a string, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+func installLink(target string, linkPath string, hard bool, force bool) error {
+	if _, err := os.Lstat(linkPath); err == nil {
+		if sameFile(target, linkPath) {
+			return nil
+		}
+		if !force {
+			return fmt.Errorf("%s already exists, use --force to replace it", linkPath)
+		}
+		err = os.Remove(linkPath)
+		if err != nil {
+			return fmt.Errorf("unable to remove %s: %w", linkPath, err)
+		}
+	}
+	var err error
+	if hard {
+		err = os.Link(target, linkPath)
+	} else {
+		err = os.Symlink(target, linkPath)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to link %s: %w", linkPath, err)
+	}
+	return nil
+}
+
+var installLinksCmd = &cobra.Command{
+	Use:          "install-links",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		hard, _ := cmd.Flags().GetBool("hard")
+		force, _ := cmd.Flags().GetBool("force")
+		dir, _ := cmd.Flags().GetString("dir")
+
+		target, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("unable to find current executable: %w", err)
+		}
+		target, err = filepath.EvalSymlinks(target)
+		if err != nil {
+			return fmt.Errorf("unable to resolve current executable: %w", err)
+		}
+		if dir == "" {
+			dir = filepath.Dir(target)
+		}
+
+		for _, name := range LinkNames {
+			// keep the .exe extension on windows so the links are found in the PATH
+			linkPath := filepath.Join(dir, name+filepath.Ext(target))
+			err = installLink(target, linkPath, hard, force)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "%s -> %s\n", linkPath, target)
+		}
+		return nil
+	},
+}
+
+func registerInstallLinksCmd(parent *cobra.Command) {
+	fs := installLinksCmd.Flags()
+	fs.String("dir", "", "directory to create the links in (default is the directory containing gcloud)")
+	fs.Bool("hard", false, "create hard links rather than symlinks")
+	fs.Bool("force", false, "replace existing files")
+	parent.AddCommand(installLinksCmd)
+}
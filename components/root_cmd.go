@@ -0,0 +1,17 @@
+package components
+
+import "github.com/spf13/cobra"
+
+var rootCmd = &cobra.Command{
+	Use: "components",
+}
+
+var rootCmdInitDone = false
+
+func GetRootCmd() *cobra.Command {
+	if !rootCmdInitDone {
+		registerInstallLinksCmd(rootCmd)
+		rootCmdInitDone = true
+	}
+	return rootCmd
+}
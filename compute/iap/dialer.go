@@ -0,0 +1,186 @@
+package iap
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gartnera/gcloud/auth"
+	"golang.org/x/oauth2"
+)
+
+// Addr is the address of an instance port reached through IAP. Its string form
+// is instance.zone.project:port, which is also what Dialer.DialContext accepts.
+type Addr struct {
+	Instance string
+	Zone     string
+	Project  string
+	Port     int
+}
+
+func (a *Addr) Network() string {
+	return "iap"
+}
+
+func (a *Addr) String() string {
+	return fmt.Sprintf("%s.%s.%s:%d", a.Instance, a.Zone, a.Project, a.Port)
+}
+
+// ParseAddr parses an instance.zone.project:port address. Domain scoped projects
+// like example.com:project are allowed.
+func ParseAddr(address string) (*Addr, error) {
+	i := strings.LastIndex(address, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("address %s: missing port", address)
+	}
+	port, err := strconv.Atoi(address[i+1:])
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("address %s: invalid port", address)
+	}
+	// instance names and zones can't contain dots, so the rest is the project
+	parts := strings.SplitN(address[:i], ".", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("address %s: expected instance.zone.project:port", address)
+	}
+	return &Addr{
+		Instance: parts[0],
+		Zone:     parts[1],
+		Project:  parts[2],
+		Port:     port,
+	}, nil
+}
+
+// localAddr is the local end of a tunnel. There is no local socket.
+type localAddr struct{}
+
+func (localAddr) Network() string {
+	return "iap"
+}
+
+func (localAddr) String() string {
+	return "local"
+}
+
+// Dialer opens connections to instance ports through IAP TCP forwarding. It is
+// safe for concurrent use, and DialContext can be used wherever a dial function
+// is expected, like grpc.WithContextDialer or http.Transport.DialContext.
+type Dialer struct {
+	ts        oauth2.TokenSource
+	iface     string
+	scheme    string
+	host      string
+	tlsConfig *tls.Config
+	userAgent string
+}
+
+type DialerOption func(d *Dialer)
+
+// WithTokenSource sets the token used to authenticate to IAP. The default is
+// the active gcloud credential.
+func WithTokenSource(ts oauth2.TokenSource) DialerOption {
+	return func(d *Dialer) {
+		d.ts = ts
+	}
+}
+
+// WithInterface sets the network interface of the instance to connect to. The
+// default is nic0.
+func WithInterface(iface string) DialerOption {
+	return func(d *Dialer) {
+		d.iface = iface
+	}
+}
+
+// WithMTLS connects to MTLS_URL_HOST and presents the client certificate in config
+func WithMTLS(config *tls.Config) DialerOption {
+	return func(d *Dialer) {
+		d.tlsConfig = config
+	}
+}
+
+// WithEndpoint connects to scheme://host instead of the IAP relay, e.g. to an
+// iaptest.Relay
+func WithEndpoint(scheme string, host string) DialerOption {
+	return func(d *Dialer) {
+		d.scheme = scheme
+		d.host = host
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent to IAP
+func WithUserAgent(userAgent string) DialerOption {
+	return func(d *Dialer) {
+		d.userAgent = userAgent
+	}
+}
+
+func NewDialer(opts ...DialerOption) *Dialer {
+	d := &Dialer{
+		iface: "nic0",
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// DialContext connects to address (instance.zone.project:port). network must be
+// tcp, tcp4, or tcp6. Like net.Dialer, ctx only applies to connecting.
+func (d *Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+	addr, err := ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	ts := d.ts
+	if ts == nil {
+		ts, err = auth.TokenSource()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get tokensource: %w", err)
+		}
+	}
+	m := &TunnelManager{
+		Project:      addr.Project,
+		Zone:         addr.Zone,
+		Instance:     addr.Instance,
+		Interface:    d.iface,
+		RemotePort:   addr.Port,
+		TokenSource:  ts,
+		TunnelScheme: d.scheme,
+		TunnelHost:   d.host,
+		TLSConfig:    d.tlsConfig,
+		userAgent:    d.userAgent,
+	}
+	adapter, err := m.startTunnel(ctx, context.Background())
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: addr, Err: err}
+	}
+	return &tunnelConn{tunnelAdapter: adapter, remoteAddr: addr}, nil
+}
+
+// tunnelConn is a net.Conn backed by a tunnel
+type tunnelConn struct {
+	*tunnelAdapter
+	remoteAddr *Addr
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr {
+	return localAddr{}
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
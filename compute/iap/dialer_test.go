@@ -0,0 +1,60 @@
+package iap_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gartnera/gcloud/compute/iap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		address string
+		want    *iap.Addr
+	}{
+		{"vm.us-west1-a.my-project:22", &iap.Addr{Instance: "vm", Zone: "us-west1-a", Project: "my-project", Port: 22}},
+		{"vm.us-west1-a.example.com:my-project:5432", &iap.Addr{Instance: "vm", Zone: "us-west1-a", Project: "example.com:my-project", Port: 5432}},
+		{"vm.us-west1-a:22", nil},
+		{"vm.us-west1-a.my-project", nil},
+		{"vm.us-west1-a.my-project:0", nil},
+		{"vm..my-project:22", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			addr, err := iap.ParseAddr(tt.address)
+			if tt.want == nil {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, addr)
+			require.Equal(t, tt.address, addr.String())
+		})
+	}
+}
+
+func TestDialer(t *testing.T) {
+	relay := newRelay(t)
+	d := iap.NewDialer(append(relay.DialerOptions(), iap.WithUserAgent("iaptest"))...)
+
+	_, err := d.DialContext(context.Background(), "udp", "vm.us-west1-a.my-project:22")
+	require.Error(t, err)
+	conn, err := d.DialContext(context.Background(), "tcp", "vm.us-west1-a.my-project:22")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "vm.us-west1-a.my-project:22", conn.RemoteAddr().String())
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = conn.Read(make([]byte, 10))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// the tunnel is still usable once the deadline is cleared
+	require.NoError(t, conn.SetDeadline(time.Time{}))
+	payload := testPayload(1000)
+	_, err = conn.Write(payload)
+	require.NoError(t, err)
+	require.Equal(t, payload, readN(t, conn, len(payload)))
+}
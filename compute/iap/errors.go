@@ -0,0 +1,139 @@
+package iap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Websocket close codes used by the relay when it rejects or ends a session
+const CLOSE_CODE_ERROR_UNKNOWN = 4000
+const CLOSE_CODE_FAILED_TO_CONNECT_TO_BACKEND = 4003
+const CLOSE_CODE_REAUTHENTICATION_REQUIRED = 4004
+const CLOSE_CODE_NOT_AUTHORIZED = 4033
+const CLOSE_CODE_LOOKUP_FAILED = 4047
+
+// IAP_SOURCE_RANGE is where tunneled connections to instances come from
+const IAP_SOURCE_RANGE = "35.235.240.0/20"
+
+var (
+	ErrNotAuthorized          = errors.New("not authorized to tunnel to the target")
+	ErrBackendUnreachable     = errors.New("failed to connect to the target port")
+	ErrTargetNotFound         = errors.New("target not found")
+	ErrReauthenticationNeeded = errors.New("reauthentication required")
+)
+
+// TunnelError is returned when IAP rejects a tunnel, either while connecting
+// (Code is the HTTP status) or by closing the websocket (Code is the close code).
+// It matches ErrNotAuthorized, ErrBackendUnreachable, ErrTargetNotFound, and
+// ErrReauthenticationNeeded with errors.Is.
+type TunnelError struct {
+	Code int
+	// Reason is the message from IAP
+	Reason string
+	// Handshake is set if IAP rejected the websocket handshake
+	Handshake bool
+}
+
+// kind returns the sentinel error matching the code, or nil
+func (e *TunnelError) kind() error {
+	if e.Handshake {
+		switch e.Code {
+		case http.StatusUnauthorized:
+			return ErrReauthenticationNeeded
+		case http.StatusForbidden:
+			return ErrNotAuthorized
+		case http.StatusNotFound:
+			return ErrTargetNotFound
+		}
+		return nil
+	}
+	switch e.Code {
+	case CLOSE_CODE_FAILED_TO_CONNECT_TO_BACKEND:
+		return ErrBackendUnreachable
+	case CLOSE_CODE_REAUTHENTICATION_REQUIRED:
+		return ErrReauthenticationNeeded
+	case CLOSE_CODE_NOT_AUTHORIZED:
+		return ErrNotAuthorized
+	case CLOSE_CODE_LOOKUP_FAILED:
+		return ErrTargetNotFound
+	}
+	return nil
+}
+
+// hint says what to fix
+func (e *TunnelError) hint() string {
+	switch e.kind() {
+	case ErrNotAuthorized:
+		return "grant roles/iap.tunnelResourceAccessor on the project, instance, or destination group to the account you are using"
+	case ErrBackendUnreachable:
+		return fmt.Sprintf("make sure the target is running and listening on the port, and that a firewall rule allows ingress from %s to it", IAP_SOURCE_RANGE)
+	case ErrTargetNotFound:
+		return "check the instance name, zone, and project (or the host, region, network, and destination group)"
+	case ErrReauthenticationNeeded:
+		return "run gcloud auth login"
+	}
+	return ""
+}
+
+func (e *TunnelError) Error() string {
+	kind := e.kind()
+	msg := "iap rejected the tunnel"
+	if kind != nil {
+		msg = kind.Error()
+	}
+	if e.Handshake {
+		msg = fmt.Sprintf("%s (http %d", msg, e.Code)
+	} else {
+		msg = fmt.Sprintf("%s (close code %d", msg, e.Code)
+	}
+	if e.Reason != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Reason)
+	}
+	msg += ")"
+	if hint := e.hint(); hint != "" {
+		msg = fmt.Sprintf("%s: %s", msg, hint)
+	}
+	return msg
+}
+
+func (e *TunnelError) Is(target error) bool {
+	kind := e.kind()
+	return kind != nil && kind == target
+}
+
+// handshakeError decodes the response of a failed websocket handshake. It
+// returns nil if there is no response, e.g. when the relay is unreachable.
+func handshakeError(resp *http.Response) error {
+	if resp == nil {
+		return nil
+	}
+	reason := http.StatusText(resp.StatusCode)
+	if resp.Body != nil {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if s := strings.TrimSpace(string(body)); s != "" {
+			reason = s
+		}
+	}
+	return &TunnelError{
+		Code:      resp.StatusCode,
+		Reason:    reason,
+		Handshake: true,
+	}
+}
+
+// closeError converts a relay close code to a TunnelError. Other errors are returned as is.
+func closeError(err error) error {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code >= CLOSE_CODE_ERROR_UNKNOWN {
+		return &TunnelError{
+			Code:   closeErr.Code,
+			Reason: closeErr.Text,
+		}
+	}
+	return err
+}
@@ -0,0 +1,611 @@
+// Package iaptest provides an in-process IAP TCP forwarding relay for tests.
+package iaptest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gartnera/gcloud/compute/iap"
+	"github.com/gorilla/websocket"
+	"golang.org/x/oauth2"
+)
+
+// Close codes sent by the relay when a connect or reconnect is rejected
+const (
+	CloseSessionUnknown           = iap.CLOSE_CODE_ERROR_UNKNOWN
+	CloseFailedToConnectToBackend = iap.CLOSE_CODE_FAILED_TO_CONNECT_TO_BACKEND
+	CloseNotAuthorized            = iap.CLOSE_CODE_NOT_AUTHORIZED
+	CloseLookupFailed             = iap.CLOSE_CODE_LOOKUP_FAILED
+)
+
+// DefaultToken is the bearer token a new Relay accepts
+const DefaultToken = "iaptest-token"
+
+// SessionInfo describes a relay session
+type SessionInfo struct {
+	SID string
+	// Received is the number of bytes received from the client
+	Received uint64
+	// Sent is the number of bytes sent to the client
+	Sent uint64
+	// ClientAck is the last ack received from the client
+	ClientAck uint64
+	// Closed is set once the session has ended
+	Closed bool
+	// ClientCertificate is the certificate the client presented when connecting
+	// to a relay started with NewTLSRelay
+	ClientCertificate *x509.Certificate
+}
+
+type session struct {
+	lock    sync.Mutex
+	sid     string
+	backend net.Conn
+	// conn is the current websocket, nil while the client is disconnected
+	conn      *websocket.Conn
+	received  uint64
+	sent      []byte
+	clientAck uint64
+	// clientCert is the certificate presented on the connect request
+	clientCert *x509.Certificate
+	// over is set once the session can't be resumed
+	over bool
+}
+
+// writeMessage sends msg on the current websocket. The session lock must be held.
+func (s *session) writeMessage(msg []byte) {
+	if s.conn != nil {
+		_ = s.conn.WriteMessage(websocket.BinaryMessage, msg)
+	}
+}
+
+// close ends the session with a close message. The session lock must be held.
+func (s *session) close(code int, text string) {
+	s.over = true
+	if s.conn != nil {
+		_ = s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.backend.Close()
+}
+
+// Relay implements the relay side of the IAP TCP forwarding protocol. Each
+// session is forwarded to a TCP backend, by default an echo server. The exported
+// fields must be set before the first connection.
+type Relay struct {
+	// Scheme and Host are the tunnel endpoint. See Configure and DialerOptions.
+	Scheme string
+	Host   string
+	// Token is the bearer token clients must present. The handshake of
+	// websockets with another token fails with 401. Empty accepts any token.
+	Token string
+	// Authorize reports if the client may connect to the target in the query
+	// of a connect request. Rejected connects are closed with CloseNotAuthorized.
+	// The default allows everything.
+	Authorize func(query url.Values) bool
+	// Lookup returns the backend address for the query of a connect request.
+	// Returning "" closes the websocket with CloseLookupFailed. The default
+	// forwards every connect to the echo server.
+	Lookup func(query url.Values) string
+	// SessionID returns the id of the nth session, which is sent to the client
+	// on connect. The default is sid-n.
+	SessionID func(n int) string
+
+	server *httptest.Server
+	echo   net.Listener
+
+	lock     sync.Mutex
+	sessions []*session
+	connects []url.Values
+	// reconnects is the number of sessions resumed
+	reconnects int
+	holdAcks   bool
+	// dropAfter drops a websocket once a session would receive more than this many bytes
+	dropAfter uint64
+	// failReconnects is the number of reconnect handshakes to fail with failReconnectsStatus
+	failReconnects       int
+	failReconnectsStatus int
+	// stallReconnects accepts reconnect websockets without ever answering
+	stallReconnects bool
+	stalled         int
+}
+
+// NewRelay starts a relay and an echo server. Call Close when done.
+func NewRelay() *Relay {
+	return newRelay(false)
+}
+
+// NewTLSRelay is like NewRelay, but the relay is served over TLS and requires
+// a client certificate like the mTLS relay does. Clients must trust the
+// relay, see TLSConfig.
+func NewTLSRelay() *Relay {
+	return newRelay(true)
+}
+
+func newRelay(useTLS bool) *Relay {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("iaptest: unable to listen: %v", err))
+	}
+	go serveEcho(echo)
+	r := &Relay{
+		Scheme: "ws",
+		Token:  DefaultToken,
+		echo:   echo,
+	}
+	r.Authorize = func(url.Values) bool {
+		return true
+	}
+	r.Lookup = func(url.Values) string {
+		return echo.Addr().String()
+	}
+	r.SessionID = func(n int) string {
+		return fmt.Sprintf("sid-%d", n)
+	}
+	upgrader := &websocket.Upgrader{
+		// the client sends the IAP origin
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	r.server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.Token != "" && req.Header.Get("Authorization") != "Bearer "+r.Token {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		if status := r.failReconnect(req); status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		r.handle(conn, req)
+	}))
+	if useTLS {
+		r.Scheme = "wss"
+		r.server.TLS = &tls.Config{
+			ClientAuth: tls.RequireAnyClientCert,
+		}
+		r.server.StartTLS()
+	} else {
+		r.server.Start()
+	}
+	r.Host = r.server.Listener.Addr().String()
+	return r
+}
+
+// serveEcho echoes everything on each connection accepted on lis
+func serveEcho(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+}
+
+// Close stops the relay and the echo server and ends all sessions
+func (r *Relay) Close() {
+	r.CloseSessions(websocket.CloseGoingAway, "relay closed")
+	r.server.Close()
+	r.echo.Close()
+}
+
+// EchoAddr is the address of the echo server
+func (r *Relay) EchoAddr() string {
+	return r.echo.Addr().String()
+}
+
+// TokenSource returns a token source with a token the relay accepts
+func (r *Relay) TokenSource() oauth2.TokenSource {
+	token := r.Token
+	if token == "" {
+		token = DefaultToken
+	}
+	return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+}
+
+// TLSConfig returns a copy of config (which may be nil) that trusts a relay
+// started with NewTLSRelay
+func (r *Relay) TLSConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.RootCAs = x509.NewCertPool()
+	config.RootCAs.AddCert(r.server.Certificate())
+	return config
+}
+
+// Configure points m at the relay
+func (r *Relay) Configure(m *iap.TunnelManager) {
+	m.TunnelScheme = r.Scheme
+	m.TunnelHost = r.Host
+	m.TokenSource = r.TokenSource()
+}
+
+// DialerOptions returns the options for an iap.Dialer which connects to the relay
+func (r *Relay) DialerOptions() []iap.DialerOption {
+	return []iap.DialerOption{
+		iap.WithEndpoint(r.Scheme, r.Host),
+		iap.WithTokenSource(r.TokenSource()),
+	}
+}
+
+// Connects returns the query of each connect request
+func (r *Relay) Connects() []url.Values {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]url.Values{}, r.connects...)
+}
+
+// Reconnects returns the number of times a session was resumed
+func (r *Relay) Reconnects() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.reconnects
+}
+
+// Sessions describes each session in the order they were created
+func (r *Relay) Sessions() []SessionInfo {
+	r.lock.Lock()
+	sessions := append([]*session{}, r.sessions...)
+	r.lock.Unlock()
+	var res []SessionInfo
+	for _, s := range sessions {
+		s.lock.Lock()
+		res = append(res, SessionInfo{
+			SID:               s.sid,
+			Received:          s.received,
+			Sent:              uint64(len(s.sent)),
+			ClientAck:         s.clientAck,
+			Closed:            s.over,
+			ClientCertificate: s.clientCert,
+		})
+		s.lock.Unlock()
+	}
+	return res
+}
+
+// SetHoldAcks stops or resumes acknowledging received data. When resuming,
+// everything received so far is acknowledged.
+func (r *Relay) SetHoldAcks(hold bool) {
+	r.lock.Lock()
+	r.holdAcks = hold
+	sessions := append([]*session{}, r.sessions...)
+	r.lock.Unlock()
+	if hold {
+		return
+	}
+	for _, s := range sessions {
+		s.lock.Lock()
+		s.writeMessage(encodeFrame(iap.SUBPROTOCOL_TAG_ACK, s.received))
+		s.lock.Unlock()
+	}
+}
+
+// DropAfter drops the websocket of the first session which would receive more
+// than n bytes. The frame which crosses n is lost, like it would be when a relay
+// is recycled, so the client has to reconnect and send it again.
+func (r *Relay) DropAfter(n uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.dropAfter = n
+}
+
+// FailReconnects fails the next n reconnect handshakes with the HTTP status,
+// like a relay which is being recycled
+func (r *Relay) FailReconnects(n int, status int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failReconnects = n
+	r.failReconnectsStatus = status
+}
+
+// failReconnect returns the status to fail the handshake of req with, or 0
+func (r *Relay) failReconnect(req *http.Request) int {
+	if !strings.HasSuffix(req.URL.Path, "/"+iap.RECONNECT_ENDPOINT) {
+		return 0
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.failReconnects == 0 {
+		return 0
+	}
+	r.failReconnects--
+	return r.failReconnectsStatus
+}
+
+// StallReconnects accepts reconnect websockets but never answers them, like a
+// relay which hangs
+func (r *Relay) StallReconnects(stall bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stallReconnects = stall
+}
+
+// StalledReconnects returns the number of reconnects which were not answered
+func (r *Relay) StalledReconnects() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.stalled
+}
+
+// DropConnections closes every websocket without ending the sessions
+func (r *Relay) DropConnections() {
+	r.lock.Lock()
+	sessions := append([]*session{}, r.sessions...)
+	r.lock.Unlock()
+	for _, s := range sessions {
+		s.lock.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.lock.Unlock()
+	}
+}
+
+// CloseSessions ends every session with a close message
+func (r *Relay) CloseSessions(code int, text string) {
+	r.lock.Lock()
+	sessions := append([]*session{}, r.sessions...)
+	r.lock.Unlock()
+	for _, s := range sessions {
+		s.lock.Lock()
+		if !s.over {
+			s.close(code, text)
+		}
+		s.lock.Unlock()
+	}
+}
+
+// SendFrame sends a frame with the tag and the length prefixed payload (like
+// CONNECT_SUCCESS_SID or DATA) to the client of each active session, e.g. to
+// test how clients handle unexpected messages
+func (r *Relay) SendFrame(tag uint16, payload []byte) {
+	r.lock.Lock()
+	sessions := append([]*session{}, r.sessions...)
+	r.lock.Unlock()
+	for _, s := range sessions {
+		s.lock.Lock()
+		if !s.over {
+			s.writeMessage(encodeFrame(tag, uint32(len(payload)), payload))
+		}
+		s.lock.Unlock()
+	}
+}
+
+// encodeFrame returns a message with the tag and payload
+func encodeFrame(tag uint16, payload ...interface{}) []byte {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.BigEndian, tag)
+	for _, p := range payload {
+		_ = binary.Write(buf, binary.BigEndian, p)
+	}
+	return buf.Bytes()
+}
+
+func encodeDataFrames(p []byte) [][]byte {
+	var frames [][]byte
+	for i := 0; i < len(p); i += iap.SUBPROTOCOL_MAX_DATA_FRAME_SIZE {
+		end := i + iap.SUBPROTOCOL_MAX_DATA_FRAME_SIZE
+		if end > len(p) {
+			end = len(p)
+		}
+		frames = append(frames, encodeFrame(iap.SUBPROTOCOL_TAG_DATA, uint32(end-i), p[i:end]))
+	}
+	return frames
+}
+
+func reject(conn *websocket.Conn, code int, text string) {
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, text))
+	conn.Close()
+}
+
+func (r *Relay) handle(conn *websocket.Conn, req *http.Request) {
+	query := req.URL.Query()
+	if strings.HasSuffix(req.URL.Path, "/"+iap.RECONNECT_ENDPOINT) {
+		r.resume(conn, query.Get("sid"), query.Get("ack"))
+		return
+	}
+
+	r.lock.Lock()
+	r.connects = append(r.connects, query)
+	r.lock.Unlock()
+	if !r.Authorize(query) {
+		reject(conn, CloseNotAuthorized, "not authorized")
+		return
+	}
+	backendAddr := r.Lookup(query)
+	if backendAddr == "" {
+		reject(conn, CloseLookupFailed, "failed to lookup instance")
+		return
+	}
+	backend, err := net.Dial("tcp", backendAddr)
+	if err != nil {
+		reject(conn, CloseFailedToConnectToBackend, "failed to connect to backend")
+		return
+	}
+
+	r.lock.Lock()
+	s := &session{
+		sid:     r.SessionID(len(r.sessions)),
+		backend: backend,
+		conn:    conn,
+	}
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		s.clientCert = req.TLS.PeerCertificates[0]
+	}
+	r.sessions = append(r.sessions, s)
+	r.lock.Unlock()
+	s.lock.Lock()
+	s.writeMessage(encodeFrame(iap.SUBPROTOCOL_TAG_CONNECT_SUCCESS_SID, uint32(len(s.sid)), []byte(s.sid)))
+	s.lock.Unlock()
+	go r.forwardBackend(s)
+	r.serve(s, conn)
+}
+
+// resume attaches a new websocket to session sid and sends what the client missed
+func (r *Relay) resume(conn *websocket.Conn, sid string, ackParam string) {
+	r.lock.Lock()
+	if r.stallReconnects {
+		r.stalled++
+		r.lock.Unlock()
+		// wait for the client to give up
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+	r.lock.Unlock()
+	var s *session
+	r.lock.Lock()
+	for _, candidate := range r.sessions {
+		if candidate.sid == sid {
+			s = candidate
+		}
+	}
+	r.lock.Unlock()
+	ack, err := strconv.ParseUint(ackParam, 10, 64)
+	if s == nil || err != nil {
+		reject(conn, CloseSessionUnknown, "unknown session")
+		return
+	}
+
+	s.lock.Lock()
+	if s.over || ack > uint64(len(s.sent)) {
+		s.lock.Unlock()
+		reject(conn, CloseSessionUnknown, "unknown session")
+		return
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = conn
+	s.writeMessage(encodeFrame(iap.SUBPROTOCOL_TAG_RECONNECT_SUCCESS_ACK, s.received))
+	for _, frame := range encodeDataFrames(s.sent[ack:]) {
+		s.writeMessage(frame)
+	}
+	s.lock.Unlock()
+
+	r.lock.Lock()
+	r.reconnects++
+	r.lock.Unlock()
+	r.serve(s, conn)
+}
+
+// forwardBackend sends what the backend writes to the client. The session ends
+// with a normal close once the backend closes its connection.
+func (r *Relay) forwardBackend(s *session) {
+	buf := make([]byte, iap.SUBPROTOCOL_MAX_DATA_FRAME_SIZE)
+	for {
+		n, err := s.backend.Read(buf)
+		s.lock.Lock()
+		if n > 0 {
+			s.sent = append(s.sent, buf[:n]...)
+			s.writeMessage(encodeFrame(iap.SUBPROTOCOL_TAG_DATA, uint32(n), buf[:n]))
+		}
+		if err != nil {
+			if !s.over {
+				s.close(websocket.CloseNormalClosure, "")
+			}
+			s.lock.Unlock()
+			return
+		}
+		s.lock.Unlock()
+	}
+}
+
+// serve forwards data from conn to the backend until conn is closed
+func (r *Relay) serve(s *session, conn *websocket.Conn) {
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err == nil {
+			err = r.handleMessage(s, conn, msg)
+		}
+		if err != nil {
+			s.lock.Lock()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) && !s.over {
+				// the client closed the session
+				s.conn = nil
+				s.close(websocket.CloseNormalClosure, "")
+			} else if s.conn == conn {
+				// the client may resume the session
+				s.conn = nil
+			}
+			conn.Close()
+			s.lock.Unlock()
+			return
+		}
+	}
+}
+
+func (r *Relay) handleMessage(s *session, conn *websocket.Conn, msg []byte) error {
+	if len(msg) < iap.SUBPROTOCOL_TAG_LEN {
+		return errors.New("message is too short")
+	}
+	tag := binary.BigEndian.Uint16(msg)
+	msg = msg[iap.SUBPROTOCOL_TAG_LEN:]
+	switch tag {
+	case iap.SUBPROTOCOL_TAG_ACK:
+		if len(msg) < 8 {
+			return errors.New("ack message is too short")
+		}
+		s.lock.Lock()
+		s.clientAck = binary.BigEndian.Uint64(msg)
+		s.lock.Unlock()
+		return nil
+	case iap.SUBPROTOCOL_TAG_DATA:
+	default:
+		return nil
+	}
+	if len(msg) < 4 || uint32(len(msg)-4) < binary.BigEndian.Uint32(msg) {
+		return errors.New("data message is too short")
+	}
+	data := msg[4 : 4+binary.BigEndian.Uint32(msg)]
+
+	r.lock.Lock()
+	s.lock.Lock()
+	drop := r.dropAfter > 0 && s.received+uint64(len(data)) > r.dropAfter
+	s.lock.Unlock()
+	if drop {
+		r.dropAfter = 0
+	}
+	holdAcks := r.holdAcks
+	r.lock.Unlock()
+	if drop {
+		return errors.New("dropped")
+	}
+
+	// the session lock is not held so the backend can write while we wait
+	if _, err := s.backend.Write(data); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.received += uint64(len(data))
+	if !holdAcks && s.conn == conn {
+		s.writeMessage(encodeFrame(iap.SUBPROTOCOL_TAG_ACK, s.received))
+	}
+	return nil
+}
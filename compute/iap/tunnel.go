@@ -3,6 +3,7 @@ package iap
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -10,12 +11,13 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/gartnera/gcloud/auth"
 	"github.com/gorilla/websocket"
 	"golang.org/x/oauth2"
-	"golang.org/x/sync/errgroup"
 )
 
 const URL_SCHEME = "wss"
@@ -36,113 +38,513 @@ const SUBPROTOCOL_TAG_RECONNECT_SUCCESS_ACK uint16 = 0x0002
 const SUBPROTOCOL_TAG_DATA uint16 = 0x0004
 const SUBPROTOCOL_TAG_ACK uint16 = 0x0007
 
-// tunnelAdapter abstracts the iap websocket tunnel to an io.ReadWriteCloser
+// RECONNECT_TIMEOUT is how long we keep trying to resume a session after the websocket drops
+const RECONNECT_TIMEOUT = 30 * time.Second
+
+// INBOUND_BUFFER_SIZE is how much received data we buffer for Read before we stop
+// reading from the websocket
+const INBOUND_BUFFER_SIZE = 1 << 20
+
+// DEFAULT_OUTBOUND_WINDOW_SIZE is the default number of written bytes which may be
+// unacknowledged by the relay before writes block
+const DEFAULT_OUTBOUND_WINDOW_SIZE = 1 << 20
+
+// dialFunc opens the tunnel websocket. sid is empty for a new session, otherwise
+// ack is the number of bytes received in the session being resumed.
+type dialFunc func(ctx context.Context, sid string, ack uint64) (*websocket.Conn, error)
+
+// tunnelAdapter abstracts the iap websocket tunnel to an io.ReadWriteCloser. If the
+// websocket drops, the session is resumed on a new websocket and any data which
+// the relay did not acknowledge is sent again.
 type tunnelAdapter struct {
-	conn    *websocket.Conn
-	inbound chan []byte
-	acks    chan uint64
+	dial dialFunc
+	// connected is closed once the relay has sent the session id
+	connected     chan struct{}
+	connectedOnce sync.Once
+	// done is closed once the inbound handler has exited
+	done chan struct{}
+
+	// outboundWindowSize is the maximum number of unacknowledged bytes
+	outboundWindowSize int
+	// inboundAckSize is how many bytes we receive before acknowledging them
+	inboundAckSize int
 
+	// writeLock serializes calls to Write so their data is not interleaved
+	writeLock sync.Mutex
+	// outboundLock serializes writes to the websocket. It is held while the
+	// unacknowledged data is replayed after a reconnect so that new data is not
+	// sent before it.
 	outboundLock sync.Mutex
 
+	// lock guards the fields below
+	lock sync.Mutex
+	// windowCond is signaled when the relay acknowledges data or the tunnel fails
+	windowCond *sync.Cond
+	// readCond is signaled when data is received, read, or the tunnel fails
+	readCond *sync.Cond
+	conn     *websocket.Conn
+	cancel   context.CancelFunc
+	// sid identifies the session for reconnects
+	sid string
+	// err is set once the tunnel is finished. It is io.EOF if the remote closed
+	// the connection and net.ErrClosed if we did.
+	err error
+	// inbound holds received data until it is read
+	inbound bytes.Buffer
+	// readDeadline and writeDeadline are checked whenever Read and Write wait.
+	// The timers wake them up once the deadline passes.
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+
 	totalInboundLen uint64
+	// inboundAcked is the number of received bytes we have acknowledged
+	inboundAcked uint64
+	// totalOutboundLen is the number of bytes written to the tunnel
+	totalOutboundLen uint64
+	// outboundAcked is the number of written bytes acknowledged by the relay
+	outboundAcked uint64
+	// unacked holds the written bytes after outboundAcked
+	unacked []byte
 }
 
-func newTunnelAdapter(conn *websocket.Conn) *tunnelAdapter {
+func newTunnelAdapter(conn *websocket.Conn, dial dialFunc) *tunnelAdapter {
 	a := &tunnelAdapter{
-		inbound: make(chan []byte),
-		acks:    make(chan uint64),
-		conn:    conn,
+		connected:          make(chan struct{}),
+		done:               make(chan struct{}),
+		conn:               conn,
+		dial:               dial,
+		outboundWindowSize: DEFAULT_OUTBOUND_WINDOW_SIZE,
 	}
+	a.windowCond = sync.NewCond(&a.lock)
+	a.readCond = sync.NewCond(&a.lock)
 	return a
 }
 
-func (a *tunnelAdapter) inboundAck(len uint64) error {
+// encodeFrame returns a message with the tag and payload
+func encodeFrame(tag uint16, payload ...interface{}) []byte {
 	buf := new(bytes.Buffer)
-	_ = binary.Write(buf, binary.BigEndian, SUBPROTOCOL_TAG_ACK)
-	_ = binary.Write(buf, binary.BigEndian, len)
+	_ = binary.Write(buf, binary.BigEndian, tag)
+	for _, p := range payload {
+		_ = binary.Write(buf, binary.BigEndian, p)
+	}
+	return buf.Bytes()
+}
 
+// encodeDataFrame returns a DATA message for p which must not be larger than SUBPROTOCOL_MAX_DATA_FRAME_SIZE
+func encodeDataFrame(p []byte) []byte {
+	return encodeFrame(SUBPROTOCOL_TAG_DATA, uint32(len(p)), p)
+}
+
+// decodeAck returns the value of an ACK or RECONNECT_SUCCESS_ACK message body
+func decodeAck(msg []byte) (uint64, error) {
+	if len(msg) < 8 {
+		return 0, errors.New("ack message is too short")
+	}
+	return binary.BigEndian.Uint64(msg[:8]), nil
+}
+
+// decodeLengthPrefixed returns the body of a DATA or CONNECT_SUCCESS_SID message body
+func decodeLengthPrefixed(msg []byte) ([]byte, error) {
+	if len(msg) < 4 {
+		return nil, errors.New("message is too short")
+	}
+	dataLen := binary.BigEndian.Uint32(msg[:4])
+	if uint64(len(msg)-4) < uint64(dataLen) {
+		return nil, errors.New("message is shorter than its length")
+	}
+	return msg[4 : dataLen+4], nil
+}
+
+func (a *tunnelAdapter) currentConn() *websocket.Conn {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.conn
+}
+
+func (a *tunnelAdapter) inboundAck(len uint64) error {
 	a.outboundLock.Lock()
 	defer a.outboundLock.Unlock()
-	err := a.conn.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+	err := a.currentConn().WriteMessage(websocket.BinaryMessage, encodeFrame(SUBPROTOCOL_TAG_ACK, len))
 	if err != nil {
 		return fmt.Errorf("unable to write inbound ack msg: %w", err)
 	}
 	return nil
 }
 
+// outboundAck releases the written data which the relay has received
+func (a *tunnelAdapter) outboundAck(ack uint64) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if ack > a.totalOutboundLen {
+		return fmt.Errorf("relay acknowledged %d bytes but only %d were sent", ack, a.totalOutboundLen)
+	}
+	if ack > a.outboundAcked {
+		a.unacked = a.unacked[ack-a.outboundAcked:]
+		a.outboundAcked = ack
+		a.windowCond.Broadcast()
+	}
+	return nil
+}
+
+// finish records that the tunnel can not be used anymore and wakes up blocked
+// readers and writers. The first error wins.
+func (a *tunnelAdapter) finish(err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.err == nil {
+		a.err = err
+	}
+	a.windowCond.Broadcast()
+	a.readCond.Broadcast()
+}
+
+// writeFrames sends p split into DATA frames. The outboundLock must be held.
+func writeFrames(conn *websocket.Conn, p []byte) error {
+	for i := 0; i < len(p); i += SUBPROTOCOL_MAX_DATA_FRAME_SIZE {
+		end := i + SUBPROTOCOL_MAX_DATA_FRAME_SIZE
+		if end > len(p) {
+			end = len(p)
+		}
+		err := conn.WriteMessage(websocket.BinaryMessage, encodeDataFrame(p[i:end]))
+		if err != nil {
+			return fmt.Errorf("unable to write to websocket: %w", err)
+		}
+	}
+	return nil
+}
+
+// shouldReconnect reports if the session may be resumed after err. The relay
+// closes with a 4xxx code when the session itself is over.
+func shouldReconnect(err error) bool {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Code != websocket.CloseNormalClosure && closeErr.Code < 4000
+	}
+	return true
+}
+
+// reconnect resumes the session on a new websocket and replays the data the relay
+// did not receive. Writes keep going to the dropped websocket until the new one
+// is ready, which is fine since they are replayed as well.
+func (a *tunnelAdapter) reconnect(ctx context.Context) error {
+	a.lock.Lock()
+	sid := a.sid
+	ack := a.totalInboundLen
+	a.lock.Unlock()
+	if sid == "" {
+		return errors.New("connection closed before the session was established")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RECONNECT_TIMEOUT)
+	defer cancel()
+	var conn *websocket.Conn
+	var err error
+	for delay := 100 * time.Millisecond; ; delay *= 2 {
+		conn, err = a.dial(ctx, sid, ack)
+		if err == nil {
+			break
+		}
+		// retrying won't help if IAP rejected us, but a relay which is being
+		// recycled fails the handshake with 429 or 5xx until it is replaced
+		var tunnelErr *TunnelError
+		if errors.As(err, &tunnelErr) && tunnelErr.kind() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("unable to reconnect: %w", err)
+		case <-time.After(delay):
+		}
+	}
+
+	// don't wait for the relay longer than the reconnect may take or after we are closed
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	// the relay tells us how much of our data it received before the drop
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetReadDeadline(deadline)
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("unable to read reconnect response: %w", closeError(err))
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if len(msg) < SUBPROTOCOL_TAG_LEN || binary.BigEndian.Uint16(msg) != SUBPROTOCOL_TAG_RECONNECT_SUCCESS_ACK {
+		conn.Close()
+		return errors.New("unexpected reconnect response")
+	}
+	relayAck, err := decodeAck(msg[SUBPROTOCOL_TAG_LEN:])
+	if err == nil {
+		err = a.outboundAck(relayAck)
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("invalid reconnect response: %w", err)
+	}
+
+	// new data must not be sent before the replayed data
+	a.outboundLock.Lock()
+	defer a.outboundLock.Unlock()
+	a.lock.Lock()
+	// Close cancels ctx with the lock held, so it either sees the new websocket or we see that it was called
+	if ctx.Err() != nil {
+		a.lock.Unlock()
+		conn.Close()
+		return fmt.Errorf("unable to reconnect: %w", ctx.Err())
+	}
+	a.conn.Close()
+	a.conn = conn
+	// the reconnect url acknowledged everything we received
+	a.inboundAcked = ack
+	replay := append([]byte{}, a.unacked...)
+	a.lock.Unlock()
+	return writeFrames(conn, replay)
+}
+
+// handleMessage processes a single message from the relay
+func (a *tunnelAdapter) handleMessage(msg []byte) error {
+	if len(msg) < SUBPROTOCOL_TAG_LEN {
+		return errors.New("message is too short")
+	}
+	subprotocolTag := binary.BigEndian.Uint16(msg[:SUBPROTOCOL_TAG_LEN])
+	msg = msg[SUBPROTOCOL_TAG_LEN:]
+	switch subprotocolTag {
+	case SUBPROTOCOL_TAG_CONNECT_SUCCESS_SID:
+		sid, err := decodeLengthPrefixed(msg)
+		if err != nil {
+			return fmt.Errorf("invalid connect success message: %w", err)
+		}
+		if len(sid) == 0 {
+			return errors.New("invalid connect success message: empty session id")
+		}
+		a.lock.Lock()
+		a.sid = string(sid)
+		a.lock.Unlock()
+		a.connectedOnce.Do(func() {
+			close(a.connected)
+		})
+	case SUBPROTOCOL_TAG_ACK, SUBPROTOCOL_TAG_RECONNECT_SUCCESS_ACK:
+		ack, err := decodeAck(msg)
+		if err != nil {
+			return err
+		}
+		return a.outboundAck(ack)
+	case SUBPROTOCOL_TAG_DATA:
+		data, err := decodeLengthPrefixed(msg)
+		if err != nil {
+			return fmt.Errorf("invalid data message: %w", err)
+		}
+		a.lock.Lock()
+		// stop reading from the relay until the reader catches up
+		for a.err == nil && a.inbound.Len() >= INBOUND_BUFFER_SIZE {
+			a.readCond.Wait()
+		}
+		_, _ = a.inbound.Write(data)
+		a.readCond.Broadcast()
+		a.totalInboundLen += uint64(len(data))
+		totalInboundLen := a.totalInboundLen
+		sendAck := totalInboundLen-a.inboundAcked >= uint64(a.inboundAckSize)
+		if sendAck {
+			a.inboundAcked = totalInboundLen
+		}
+		a.lock.Unlock()
+		if !sendAck {
+			return nil
+		}
+		// if the websocket dropped, the ack is sent in the reconnect url
+		_ = a.inboundAck(totalInboundLen)
+	default:
+		// like the other clients, ignore tags added to the protocol later
+	}
+	return nil
+}
+
+// inboundHandler reads from the relay until the session is over. It returns
+// io.EOF if the remote closed the connection.
 func (a *tunnelAdapter) inboundHandler(ctx context.Context) error {
 	for {
-		_, msg, err := a.conn.ReadMessage()
+		_, msg, err := a.currentConn().ReadMessage()
 		if err != nil {
-			return fmt.Errorf("error while reading message: %w", err)
-		}
-		subprotocolTag := binary.BigEndian.Uint16(msg[:SUBPROTOCOL_TAG_LEN])
-		msg = msg[SUBPROTOCOL_TAG_LEN:]
-		if subprotocolTag == SUBPROTOCOL_TAG_CONNECT_SUCCESS_SID {
-			continue
-		} else if subprotocolTag == SUBPROTOCOL_TAG_ACK {
-			// ack := binary.BigEndian.Uint64(msg)
-			continue
-		} else if subprotocolTag == SUBPROTOCOL_TAG_DATA {
-			dataLen := binary.BigEndian.Uint32(msg[:4])
-			msg = msg[4 : dataLen+4]
-			a.inbound <- msg
-			a.totalInboundLen += uint64(len(msg))
-			err = a.inboundAck(a.totalInboundLen)
+			if ctx.Err() != nil {
+				return net.ErrClosed
+			}
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return io.EOF
+			}
+			if !shouldReconnect(err) {
+				var tunnelErr *TunnelError
+				if err := closeError(err); errors.As(err, &tunnelErr) {
+					return err
+				}
+				return fmt.Errorf("error while reading message: %w", err)
+			}
+			err = a.reconnect(ctx)
 			if err != nil {
-				fmt.Println("inbound ack err: %w", err)
+				return err
 			}
-		} else {
-			return errors.New("unknown tag")
+			continue
+		}
+		err = a.handleMessage(msg)
+		if err != nil {
+			return err
 		}
 	}
 }
 
+// Read returns buffered data from the relay. Once the tunnel is finished and
+// the buffer is drained it returns io.EOF or the error which ended the tunnel.
 func (a *tunnelAdapter) Read(p []byte) (int, error) {
-	msg := <-a.inbound
-	len := copy(p, msg)
-	return len, nil
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for a.err == nil && a.inbound.Len() == 0 {
+		if deadlinePassed(a.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		a.readCond.Wait()
+	}
+	// data which arrived before the remote closed can still be read
+	if a.inbound.Len() > 0 && a.err != net.ErrClosed {
+		n, _ := a.inbound.Read(p)
+		a.readCond.Broadcast()
+		return n, nil
+	}
+	return 0, a.err
 }
 
+// Write sends p to the relay. p is kept until the relay acknowledges it so that
+// it can be sent again if the websocket drops before then. Write blocks while
+// outboundWindowSize bytes are unacknowledged.
 func (a *tunnelAdapter) Write(p []byte) (int, error) {
-	for i := 0; i < len(p); i += SUBPROTOCOL_MAX_DATA_FRAME_SIZE {
-		maxOrEnd := len(p)
-		if maxOrEnd-i > SUBPROTOCOL_MAX_DATA_FRAME_SIZE {
-			maxOrEnd = i + SUBPROTOCOL_MAX_DATA_FRAME_SIZE
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+	written := 0
+	for written < len(p) {
+		a.lock.Lock()
+		for a.err == nil && len(a.unacked) >= a.outboundWindowSize {
+			if deadlinePassed(a.writeDeadline) {
+				a.lock.Unlock()
+				return written, os.ErrDeadlineExceeded
+			}
+			a.windowCond.Wait()
+		}
+		if a.err != nil {
+			err := a.err
+			a.lock.Unlock()
+			if err == io.EOF {
+				err = io.ErrClosedPipe
+			}
+			return written, err
+		}
+		n := a.outboundWindowSize - len(a.unacked)
+		if n > len(p)-written {
+			n = len(p) - written
 		}
-		currentLen := maxOrEnd - i
-		buf := new(bytes.Buffer)
-		_ = binary.Write(buf, binary.BigEndian, SUBPROTOCOL_TAG_DATA)
-		_ = binary.Write(buf, binary.BigEndian, uint32(currentLen))
-		_, _ = buf.Write(p[i:maxOrEnd])
+		a.lock.Unlock()
+		chunk := p[written : written+n]
 
 		a.outboundLock.Lock()
-		err := a.conn.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+		a.lock.Lock()
+		a.unacked = append(a.unacked, chunk...)
+		a.totalOutboundLen += uint64(n)
+		conn := a.conn
+		a.lock.Unlock()
+		// if the websocket dropped, the data is sent again once we reconnect
+		_ = writeFrames(conn, chunk)
 		a.outboundLock.Unlock()
-		if err != nil {
-			return 0, fmt.Errorf("unable to write to websocket: %w", err)
-		}
+		written += n
 	}
-	return len(p), nil
+	return written, nil
+}
+
+// deadlinePassed reports if deadline is set and has passed
+func deadlinePassed(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
 }
 
+// setDeadline sets deadline and wakes up the waiters on cond once it passes. The
+// lock must be held.
+func (a *tunnelAdapter) setDeadline(deadline *time.Time, timer **time.Timer, cond *sync.Cond, t time.Time) {
+	*deadline = t
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if !t.IsZero() {
+		*timer = time.AfterFunc(time.Until(t), func() {
+			a.lock.Lock()
+			defer a.lock.Unlock()
+			cond.Broadcast()
+		})
+	}
+	cond.Broadcast()
+}
+
+// SetReadDeadline makes blocked and future calls to Read return
+// os.ErrDeadlineExceeded once t has passed. A zero t disables the deadline.
+func (a *tunnelAdapter) SetReadDeadline(t time.Time) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.setDeadline(&a.readDeadline, &a.readTimer, a.readCond, t)
+	return nil
+}
+
+// SetWriteDeadline makes calls to Write which wait for the relay to acknowledge
+// data return os.ErrDeadlineExceeded once t has passed. A zero t disables the deadline.
+func (a *tunnelAdapter) SetWriteDeadline(t time.Time) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.setDeadline(&a.writeDeadline, &a.writeTimer, a.windowCond, t)
+	return nil
+}
+
+// Close closes the websocket and waits for the inbound handler to exit. Blocked
+// reads and writes return net.ErrClosed.
 func (a *tunnelAdapter) Close() error {
+	a.finish(net.ErrClosed)
+	a.lock.Lock()
+	a.cancel()
+	conn := a.conn
+	a.lock.Unlock()
+	a.outboundLock.Lock()
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	a.outboundLock.Unlock()
+	conn.Close()
+	<-a.done
 	return nil
 }
 
-func (a *tunnelAdapter) Start(ctx context.Context) {
-	eg, ctx := errgroup.WithContext(ctx)
-	eg.Go(func() error {
-		err := a.inboundHandler(ctx)
-		if err != nil {
-			fmt.Println("error in inboundHandler: %w", err)
+// start handles messages from the relay until the tunnel is closed or ctx is done
+func (a *tunnelAdapter) start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	a.lock.Lock()
+	a.cancel = cancel
+	a.lock.Unlock()
+	go func() {
+		defer close(a.done)
+		a.finish(a.inboundHandler(ctx))
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-a.done:
 		}
-		return err
-	})
-	err := eg.Wait()
-	if err != nil {
-		fmt.Println("error in tunnel adapter: %w", err)
-	}
+		_ = a.Close()
+	}()
 }
 
 type TunnelManager struct {
@@ -150,87 +552,244 @@ type TunnelManager struct {
 	RemotePort int
 	LocalPort  int
 
+	// Zone, Instance, and Interface select a network interface of an instance.
+	// Interface defaults to nic0.
 	Zone      string
 	Instance  string
 	Interface string
 
-	ts oauth2.TokenSource
+	// Host, Region, Network, and DestGroup select a host outside of GCE which is
+	// reachable through a destination group. Host is an IP address or FQDN. They
+	// are used instead of Zone and Instance when Host is set.
+	Host      string
+	Region    string
+	Network   string
+	DestGroup string
+
+	// OutboundWindowSize is the maximum number of bytes written to a tunnel which
+	// the relay has not acknowledged. Writes block once it is reached. Defaults to
+	// DEFAULT_OUTBOUND_WINDOW_SIZE.
+	OutboundWindowSize int
+	// InboundAckSize is how many received bytes may be unacknowledged before we
+	// acknowledge them. Defaults to acknowledging every frame.
+	InboundAckSize int
+
+	// TokenSource authenticates to IAP. Defaults to the active gcloud credential.
+	TokenSource oauth2.TokenSource
+	// TunnelScheme and TunnelHost override URL_SCHEME and URL_HOST, e.g. to
+	// connect to an iaptest.Relay
+	TunnelScheme string
+	TunnelHost   string
+
+	// TLSConfig presents a client certificate for context aware access. The
+	// tunnel then uses MTLS_URL_HOST unless TunnelHost is set.
+	TLSConfig *tls.Config
+	userAgent string
 }
 
 func (m *TunnelManager) getHeaders() (http.Header, error) {
-	tok, err := m.ts.Token()
+	tok, err := m.TokenSource.Token()
 	if err != nil {
 		return nil, fmt.Errorf("unable to get token: %w", err)
 	}
-	return http.Header{
+	headers := http.Header{
 		"Origin":        []string{TUNNEL_CLOUDPROXY_ORIGIN},
 		"Authorization": []string{fmt.Sprintf("Bearer %s", tok.AccessToken)},
-	}, nil
-}
-
-func (m *TunnelManager) StartTunnel(ctx context.Context) (io.ReadWriteCloser, error) {
-	var err error
-	if m.ts == nil {
-		m.ts, err = auth.TokenSource()
-		if err != nil {
-			return nil, fmt.Errorf("unable to get tokensource: %w", err)
-		}
 	}
+	if m.userAgent != "" {
+		headers.Set("User-Agent", m.userAgent)
+	}
+	return headers, nil
+}
 
+// tunnelURL returns the url to start a new session, or to resume session sid
+func (m *TunnelManager) tunnelURL(sid string, ack uint64) *url.URL {
 	tunnelUrl := &url.URL{
 		Scheme: URL_SCHEME,
 		Host:   URL_HOST,
-		Path:   fmt.Sprintf("%s/%s", URL_PATH_ROOT, CONNECT_ENDPOINT),
+	}
+	if m.TunnelScheme != "" {
+		tunnelUrl.Scheme = m.TunnelScheme
+	}
+	if m.TLSConfig != nil {
+		tunnelUrl.Host = MTLS_URL_HOST
+	}
+	if m.TunnelHost != "" {
+		tunnelUrl.Host = m.TunnelHost
 	}
 	query := tunnelUrl.Query()
-	query.Add("project", m.Project)
-	query.Add("zone", m.Zone)
-	query.Add("instance", m.Instance)
-	query.Add("interface", "nic0")
-	query.Add("port", fmt.Sprint(m.RemotePort))
+	if sid == "" {
+		tunnelUrl.Path = fmt.Sprintf("%s/%s", URL_PATH_ROOT, CONNECT_ENDPOINT)
+		query.Add("project", m.Project)
+		if m.Host != "" {
+			query.Add("host", m.Host)
+			query.Add("region", m.Region)
+			query.Add("network", m.Network)
+			if m.DestGroup != "" {
+				query.Add("group", m.DestGroup)
+			}
+		} else {
+			query.Add("zone", m.Zone)
+			query.Add("instance", m.Instance)
+			iface := m.Interface
+			if iface == "" {
+				iface = "nic0"
+			}
+			query.Add("interface", iface)
+		}
+		query.Add("port", fmt.Sprint(m.RemotePort))
+	} else {
+		tunnelUrl.Path = fmt.Sprintf("%s/%s", URL_PATH_ROOT, RECONNECT_ENDPOINT)
+		query.Add("sid", sid)
+		query.Add("ack", fmt.Sprint(ack))
+		// the session is resumed by a relay in the same location
+		if m.Host != "" {
+			query.Add("region", m.Region)
+		} else {
+			query.Add("zone", m.Zone)
+		}
+	}
 	tunnelUrl.RawQuery = query.Encode()
+	return tunnelUrl
+}
 
+// dial opens the tunnel websocket. The headers are created for each dial so
+// that reconnects use a fresh token.
+func (m *TunnelManager) dial(ctx context.Context, sid string, ack uint64) (*websocket.Conn, error) {
 	headers, err := m.getHeaders()
 	if err != nil {
 		return nil, fmt.Errorf("unable to get connect headers: %w", err)
 	}
-
-	urlStr := tunnelUrl.String()
-
-	conn, _, err := websocket.DefaultDialer.Dial(urlStr, headers)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = m.TLSConfig
+	conn, resp, err := dialer.DialContext(ctx, m.tunnelURL(sid, ack).String(), headers)
 	if err != nil {
+		if tunnelErr := handshakeError(resp); tunnelErr != nil {
+			return nil, tunnelErr
+		}
 		return nil, fmt.Errorf("unable to connect: %w", err)
 	}
-	adapter := newTunnelAdapter(conn)
-	go adapter.Start(ctx)
+	return conn, nil
+}
+
+func (m *TunnelManager) StartTunnel(ctx context.Context) (io.ReadWriteCloser, error) {
+	adapter, err := m.startTunnel(ctx, ctx)
+	if err != nil {
+		// not a nil *tunnelAdapter in a non-nil interface
+		return nil, err
+	}
 	return adapter, nil
 }
 
+// startTunnel connects with ctx. The tunnel is closed once lifetime is done.
+func (m *TunnelManager) startTunnel(ctx context.Context, lifetime context.Context) (*tunnelAdapter, error) {
+	var err error
+	if m.TokenSource == nil {
+		m.TokenSource, err = auth.TokenSource()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get tokensource: %w", err)
+		}
+	}
+
+	conn, err := m.dial(ctx, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	adapter := newTunnelAdapter(conn, m.dial)
+	if m.OutboundWindowSize > 0 {
+		adapter.outboundWindowSize = m.OutboundWindowSize
+	}
+	adapter.inboundAckSize = m.InboundAckSize
+	adapter.start(lifetime)
+
+	// IAP accepts the websocket before it connects to the target, so wait for
+	// the session to start to report rejections here
+	select {
+	case <-adapter.connected:
+		return adapter, nil
+	case <-adapter.done:
+		adapter.lock.Lock()
+		err = adapter.err
+		adapter.lock.Unlock()
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	adapter.Close()
+	return nil, err
+}
+
 func (m *TunnelManager) StartProxy(ctx context.Context) error {
 	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", m.LocalPort))
 	if err != nil {
 		return fmt.Errorf("unable to listen: %w", err)
 	}
+	return m.Serve(ctx, lis)
+}
+
+// Serve tunnels each connection accepted on lis until ctx is done. A tunnel which
+// fails only closes its own connection. lis is closed and all tunnels are closed
+// when Serve returns.
+func (m *TunnelManager) Serve(ctx context.Context, lis net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	defer lis.Close()
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+	}()
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			return fmt.Errorf("unable to accept: %w", err)
 		}
-		tunnel, err := m.StartTunnel(ctx)
-		if err != nil {
-			return fmt.Errorf("unable to start tunnel: %w", err)
-		}
+		wg.Add(1)
 		go func() {
-			_, err := io.Copy(conn, tunnel)
-			if err != nil {
-				fmt.Println("unable to copy from tunnel to conn", err)
-			}
-		}()
-		go func() {
-			_, err := io.Copy(tunnel, conn)
-			if err != nil {
-				fmt.Println("unable to copy from conn to tunnel", err)
-			}
+			defer wg.Done()
+			m.handleConn(ctx, conn)
 		}()
 	}
 }
+
+// Pipe copies src to the tunnel and the tunnel to dst until the remote end
+// closes the session or copying fails. The tunnel protocol has no way to signal
+// a half close, so once src is exhausted we stop writing but keep reading until
+// the remote closes. It returns nil if the remote closed the session. The caller
+// closes the tunnel.
+func Pipe(tunnel io.ReadWriter, src io.Reader, dst io.Writer) error {
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(tunnel, src)
+		if err != nil {
+			errCh <- fmt.Errorf("unable to copy to tunnel: %w", err)
+		}
+	}()
+	go func() {
+		_, err := io.Copy(dst, tunnel)
+		if err != nil {
+			err = fmt.Errorf("unable to copy from tunnel: %w", err)
+		}
+		errCh <- err
+	}()
+	return <-errCh
+}
+
+// handleConn pipes between conn and a new tunnel. A client which only closes its
+// side for writing still gets the rest of the response.
+func (m *TunnelManager) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	tunnel, err := m.StartTunnel(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to start tunnel: %s\n", err)
+		return
+	}
+	defer tunnel.Close()
+	err = Pipe(tunnel, conn, conn)
+	if err != nil && ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Fprintf(os.Stderr, "tunnel error: %s\n", err)
+	}
+}
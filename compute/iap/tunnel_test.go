@@ -1,13 +1,28 @@
-package iap
+package iap_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/augustoroman/hexdump"
+	"github.com/gartnera/gcloud/compute/iap"
+	"github.com/gartnera/gcloud/compute/iap/iaptest"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 )
 
@@ -18,7 +33,7 @@ func TestStartTunnel(t *testing.T) {
 
 	ctx := context.Background()
 
-	m := TunnelManager{
+	m := iap.TunnelManager{
 		Project:    os.Getenv("GOOGLE_PROJECT_ID"),
 		Zone:       "us-west1-c",
 		Instance:   os.Getenv("TEST_INSTANCE_NAME"),
@@ -27,7 +42,7 @@ func TestStartTunnel(t *testing.T) {
 	}
 	tunnel, err := m.StartTunnel(ctx)
 	require.NoError(t, err)
-	buf := make([]byte, SUBPROTOCOL_MAX_DATA_FRAME_SIZE)
+	buf := make([]byte, iap.SUBPROTOCOL_MAX_DATA_FRAME_SIZE)
 	i, err := tunnel.Read(buf)
 	require.NoError(t, err)
 	fmt.Println(i)
@@ -48,7 +63,7 @@ func TestStartProxy(t *testing.T) {
 
 	ctx := context.Background()
 
-	m := TunnelManager{
+	m := iap.TunnelManager{
 		Project:    os.Getenv("GOOGLE_PROJECT_ID"),
 		Zone:       "us-west1-c",
 		Instance:   os.Getenv("TEST_INSTANCE_NAME"),
@@ -59,3 +74,559 @@ func TestStartProxy(t *testing.T) {
 	err := m.StartProxy(ctx)
 	require.NoError(t, err)
 }
+
+// readN reads exactly n bytes from the tunnel
+func readN(t *testing.T, r io.Reader, n int) []byte {
+	res := make([]byte, n)
+	_, err := io.ReadFull(r, res)
+	require.NoError(t, err)
+	return res
+}
+
+func testPayload(n int) []byte {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	return payload
+}
+
+func newRelay(t *testing.T) *iaptest.Relay {
+	relay := iaptest.NewRelay()
+	t.Cleanup(relay.Close)
+	return relay
+}
+
+// startTunnel starts a tunnel through relay. configure may change the manager
+// before the tunnel is started.
+func startTunnel(t *testing.T, ctx context.Context, relay *iaptest.Relay, configure ...func(m *iap.TunnelManager)) io.ReadWriteCloser {
+	m := &iap.TunnelManager{
+		Project:    "my-project",
+		Zone:       "us-west1-a",
+		Instance:   "vm",
+		RemotePort: 22,
+	}
+	relay.Configure(m)
+	for _, c := range configure {
+		c(m)
+	}
+	tunnel, err := m.StartTunnel(ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		tunnel.Close()
+	})
+	return tunnel
+}
+
+func TestConnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := newRelay(t)
+	tunnel := startTunnel(t, ctx, relay)
+
+	payload := testPayload(1000)
+	_, err := tunnel.Write(payload)
+	require.NoError(t, err)
+	require.Equal(t, payload, readN(t, tunnel, len(payload)))
+
+	connects := relay.Connects()
+	require.Len(t, connects, 1)
+	require.Equal(t, "my-project", connects[0].Get("project"))
+	require.Equal(t, "us-west1-a", connects[0].Get("zone"))
+	require.Equal(t, "vm", connects[0].Get("instance"))
+	require.Equal(t, "nic0", connects[0].Get("interface"))
+	require.Equal(t, "22", connects[0].Get("port"))
+}
+
+func TestConnectTargets(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(m *iap.TunnelManager)
+		want      url.Values
+	}{
+		{
+			name: "interface",
+			configure: func(m *iap.TunnelManager) {
+				m.Interface = "nic1"
+			},
+			want: url.Values{"project": {"my-project"}, "zone": {"us-west1-a"}, "instance": {"vm"}, "interface": {"nic1"}, "port": {"22"}},
+		},
+		{
+			name: "dest group",
+			configure: func(m *iap.TunnelManager) {
+				m.Host = "10.0.0.5"
+				m.Region = "us-west1"
+				m.Network = "lab"
+				m.DestGroup = "lab-hosts"
+			},
+			want: url.Values{"project": {"my-project"}, "host": {"10.0.0.5"}, "region": {"us-west1"}, "network": {"lab"}, "group": {"lab-hosts"}, "port": {"22"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			relay := newRelay(t)
+			tunnel := startTunnel(t, ctx, relay, tt.configure)
+			payload := testPayload(100)
+			_, err := tunnel.Write(payload)
+			require.NoError(t, err)
+			require.Equal(t, payload, readN(t, tunnel, len(payload)))
+			require.Equal(t, []url.Values{tt.want}, relay.Connects())
+		})
+	}
+}
+
+func TestConnectRejected(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(relay *iaptest.Relay)
+		want      error
+		code      int
+		hint      string
+	}{
+		{
+			name: "handshake",
+			configure: func(relay *iaptest.Relay) {
+				relay.Token = "other-token"
+			},
+			want: iap.ErrReauthenticationNeeded,
+			code: http.StatusUnauthorized,
+			hint: "invalid credentials",
+		},
+		{
+			name: "not authorized",
+			configure: func(relay *iaptest.Relay) {
+				relay.Authorize = func(url.Values) bool {
+					return false
+				}
+			},
+			want: iap.ErrNotAuthorized,
+			code: iap.CLOSE_CODE_NOT_AUTHORIZED,
+			hint: "roles/iap.tunnelResourceAccessor",
+		},
+		{
+			name: "lookup failed",
+			configure: func(relay *iaptest.Relay) {
+				relay.Lookup = func(url.Values) string {
+					return ""
+				}
+			},
+			want: iap.ErrTargetNotFound,
+			code: iap.CLOSE_CODE_LOOKUP_FAILED,
+			hint: "check the instance name",
+		},
+		{
+			name: "backend unreachable",
+			configure: func(relay *iaptest.Relay) {
+				relay.Lookup = func(url.Values) string {
+					// nothing listens on port 1
+					return "127.0.0.1:1"
+				}
+			},
+			want: iap.ErrBackendUnreachable,
+			code: iap.CLOSE_CODE_FAILED_TO_CONNECT_TO_BACKEND,
+			hint: iap.IAP_SOURCE_RANGE,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newRelay(t)
+			m := &iap.TunnelManager{Project: "my-project", Zone: "us-west1-a", Instance: "vm", RemotePort: 22}
+			relay.Configure(m)
+			tt.configure(relay)
+			tunnel, err := m.StartTunnel(context.Background())
+			require.ErrorIs(t, err, tt.want)
+			// callers may check the tunnel rather than the error
+			require.True(t, tunnel == nil)
+			var tunnelErr *iap.TunnelError
+			require.ErrorAs(t, err, &tunnelErr)
+			require.Equal(t, tt.code, tunnelErr.Code)
+			require.Contains(t, err.Error(), tt.hint)
+			require.Equal(t, 0, relay.Reconnects())
+		})
+	}
+}
+
+// clientCertificate returns a self-signed client certificate
+func clientCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func TestConnectMTLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := iaptest.NewTLSRelay()
+	t.Cleanup(relay.Close)
+
+	cert := clientCertificate(t)
+	tunnel := startTunnel(t, ctx, relay, func(m *iap.TunnelManager) {
+		m.TLSConfig = relay.TLSConfig(&tls.Config{
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			},
+		})
+	})
+	payload := testPayload(1000)
+	_, err := tunnel.Write(payload)
+	require.NoError(t, err)
+	require.Equal(t, payload, readN(t, tunnel, len(payload)))
+
+	sessions := relay.Sessions()
+	require.Len(t, sessions, 1)
+	require.NotNil(t, sessions[0].ClientCertificate)
+	require.Equal(t, cert.Certificate[0], sessions[0].ClientCertificate.Raw)
+
+	// the relay rejects clients without a certificate
+	m := &iap.TunnelManager{
+		Project:    "my-project",
+		Zone:       "us-west1-a",
+		Instance:   "vm",
+		RemotePort: 22,
+	}
+	relay.Configure(m)
+	m.TLSConfig = relay.TLSConfig(nil)
+	_, err = m.StartTunnel(ctx)
+	require.Error(t, err)
+	require.Len(t, relay.Sessions(), 1)
+}
+
+func TestReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := newRelay(t)
+	relay.DropAfter(50000)
+	tunnel := startTunnel(t, ctx, relay)
+
+	payload := testPayload(100000)
+	go func() {
+		_, _ = tunnel.Write(payload)
+	}()
+	require.Equal(t, payload, readN(t, tunnel, len(payload)))
+	require.Len(t, relay.Connects(), 1)
+	require.Equal(t, 1, relay.Reconnects())
+}
+
+func TestReconnectUnavailable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := newRelay(t)
+	tunnel := startTunnel(t, ctx, relay)
+
+	// the relay is recycled and returns 503 for a while
+	relay.FailReconnects(2, http.StatusServiceUnavailable)
+	relay.DropConnections()
+	payload := testPayload(1000)
+	_, err := tunnel.Write(payload)
+	require.NoError(t, err)
+	require.Equal(t, payload, readN(t, tunnel, len(payload)))
+	require.Equal(t, 1, relay.Reconnects())
+}
+
+func TestCloseWhileReconnecting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := newRelay(t)
+	tunnel := startTunnel(t, ctx, relay)
+
+	relay.StallReconnects(true)
+	relay.DropConnections()
+	require.Eventually(t, func() bool {
+		return relay.StalledReconnects() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	// writes don't wait for the reconnect
+	_, err := tunnel.Write([]byte("data"))
+	require.NoError(t, err)
+
+	closed := make(chan error)
+	go func() {
+		closed <- tunnel.Close()
+	}()
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked on the reconnect")
+	}
+}
+
+func TestDropConnections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := newRelay(t)
+	tunnel := startTunnel(t, ctx, relay)
+
+	for i := 0; i < 3; i++ {
+		payload := testPayload(1000 * (i + 1))
+		_, err := tunnel.Write(payload)
+		require.NoError(t, err)
+		require.Equal(t, payload, readN(t, tunnel, len(payload)))
+		relay.DropConnections()
+	}
+	require.Eventually(t, func() bool {
+		return relay.Reconnects() == 3
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestOutboundWindow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := newRelay(t)
+	relay.SetHoldAcks(true)
+	window := 2 * iap.SUBPROTOCOL_MAX_DATA_FRAME_SIZE
+	tunnel := startTunnel(t, ctx, relay, func(m *iap.TunnelManager) {
+		m.OutboundWindowSize = window
+	})
+
+	payload := testPayload(100000)
+	written := make(chan error)
+	go func() {
+		_, err := tunnel.Write(payload)
+		written <- err
+	}()
+	echoed := make(chan []byte)
+	go func() {
+		echoed <- readN(t, tunnel, len(payload))
+	}()
+
+	// the write stalls once the window is full
+	received := func() uint64 {
+		return relay.Sessions()[0].Received
+	}
+	require.Eventually(t, func() bool {
+		return received() == uint64(window)
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-written:
+		t.Fatal("write completed without acks")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.Equal(t, uint64(window), received())
+
+	relay.SetHoldAcks(false)
+	require.NoError(t, <-written)
+	require.Equal(t, payload, <-echoed)
+}
+
+func TestInboundAckSize(t *testing.T) {
+	for _, ackSize := range []int{0, 3 * iap.SUBPROTOCOL_MAX_DATA_FRAME_SIZE} {
+		ctx, cancel := context.WithCancel(context.Background())
+		relay := newRelay(t)
+		tunnel := startTunnel(t, ctx, relay, func(m *iap.TunnelManager) {
+			m.InboundAckSize = ackSize
+		})
+		payload := testPayload(100000)
+		go func() {
+			_, _ = tunnel.Write(payload)
+		}()
+		require.Equal(t, payload, readN(t, tunnel, len(payload)))
+		// less than ackSize is left unacknowledged
+		require.Eventually(t, func() bool {
+			acked := relay.Sessions()[0].ClientAck
+			return acked > 0 && uint64(len(payload))-acked <= uint64(ackSize)
+		}, time.Second, 10*time.Millisecond, "ack size %d", ackSize)
+		cancel()
+	}
+}
+
+func TestPartialRead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := newRelay(t)
+	tunnel := startTunnel(t, ctx, relay)
+
+	payload := testPayload(1000)
+	_, err := tunnel.Write(payload)
+	require.NoError(t, err)
+	var res []byte
+	buf := make([]byte, 7)
+	for len(res) < len(payload) {
+		i, err := tunnel.Read(buf)
+		require.NoError(t, err)
+		require.LessOrEqual(t, i, len(buf))
+		res = append(res, buf[:i]...)
+	}
+	require.Equal(t, payload, res)
+}
+
+func TestConnectEmptySessionID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	relay := newRelay(t)
+	relay.SessionID = func(int) string {
+		return ""
+	}
+	m := &iap.TunnelManager{
+		Project:    "my-project",
+		Zone:       "us-west1-a",
+		Instance:   "vm",
+		RemotePort: 22,
+	}
+	relay.Configure(m)
+	_, err := m.StartTunnel(ctx)
+	require.ErrorContains(t, err, "empty session id")
+}
+
+func TestRepeatedConnectSuccess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := newRelay(t)
+	tunnel := startTunnel(t, ctx, relay)
+
+	// a repeated session id must not end the tunnel
+	relay.SendFrame(iap.SUBPROTOCOL_TAG_CONNECT_SUCCESS_SID, []byte("sid-0"))
+	relay.SendFrame(iap.SUBPROTOCOL_TAG_CONNECT_SUCCESS_SID, []byte("sid-0"))
+	payload := testPayload(1000)
+	_, err := tunnel.Write(payload)
+	require.NoError(t, err)
+	require.Equal(t, payload, readN(t, tunnel, len(payload)))
+}
+
+func TestRemoteClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := newRelay(t)
+	tunnel := startTunnel(t, ctx, relay)
+
+	payload := testPayload(1000)
+	_, err := tunnel.Write(payload)
+	require.NoError(t, err)
+	// wait for the echo so it is sent before the close
+	require.Eventually(t, func() bool {
+		return relay.Sessions()[0].Sent == uint64(len(payload))
+	}, time.Second, 10*time.Millisecond)
+	relay.CloseSessions(websocket.CloseNormalClosure, "")
+
+	res, err := io.ReadAll(tunnel)
+	require.NoError(t, err)
+	require.Equal(t, payload, res)
+	_, err = tunnel.Write(payload)
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+	require.NoError(t, tunnel.Close())
+}
+
+func TestClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := newRelay(t)
+	tunnel := startTunnel(t, ctx, relay)
+
+	errs := make(chan error)
+	go func() {
+		_, err := tunnel.Read(make([]byte, 10))
+		errs <- err
+	}()
+	require.NoError(t, tunnel.Close())
+	require.ErrorIs(t, <-errs, net.ErrClosed)
+	_, err := tunnel.Write([]byte("data"))
+	require.ErrorIs(t, err, net.ErrClosed)
+	// closing twice is fine
+	require.NoError(t, tunnel.Close())
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	relay := newRelay(t)
+	tunnel := startTunnel(t, ctx, relay)
+
+	cancel()
+	_, err := tunnel.Read(make([]byte, 10))
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestServe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	relay := newRelay(t)
+	// the first tunnel fails, which only closes its own connection
+	var lock sync.Mutex
+	lookups := 0
+	relay.Lookup = func(url.Values) string {
+		lock.Lock()
+		defer lock.Unlock()
+		lookups++
+		if lookups == 1 {
+			return ""
+		}
+		return relay.EchoAddr()
+	}
+	m := &iap.TunnelManager{Project: "my-project", Zone: "us-west1-a", Instance: "vm", RemotePort: 22}
+	relay.Configure(m)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error)
+	go func() {
+		served <- m.Serve(ctx, lis)
+	}()
+
+	failed, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer failed.Close()
+	_, err = io.ReadAll(failed)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	payload := testPayload(1000)
+	_, err = conn.Write(payload)
+	require.NoError(t, err)
+	require.Equal(t, payload, readN(t, conn, len(payload)))
+
+	// cancelling closes the listener and the open tunnels
+	cancel()
+	require.NoError(t, <-served)
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err)
+}
+
+func TestServeLocalClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relay := newRelay(t)
+	m := &iap.TunnelManager{Project: "my-project", Zone: "us-west1-a", Instance: "vm", RemotePort: 22}
+	relay.Configure(m)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = m.Serve(ctx, lis)
+	}()
+
+	// a client which is done writing still gets the response
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	payload := testPayload(1000)
+	_, err = conn.Write(payload)
+	require.NoError(t, err)
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	require.Equal(t, payload, readN(t, conn, len(payload)))
+	require.Len(t, relay.Sessions(), 1)
+	require.False(t, relay.Sessions()[0].Closed)
+	conn.Close()
+
+	// a client which is killed ends its session
+	conn, err = net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write(payload)
+	require.NoError(t, err)
+	require.Equal(t, payload, readN(t, conn, len(payload)))
+	require.NoError(t, conn.(*net.TCPConn).SetLinger(0))
+	conn.Close()
+	require.Eventually(t, func() bool {
+		sessions := relay.Sessions()
+		return len(sessions) == 2 && sessions[1].Closed
+	}, time.Second, 10*time.Millisecond)
+}
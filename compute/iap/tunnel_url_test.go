@@ -0,0 +1,35 @@
+package iap
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelURL(t *testing.T) {
+	m := &TunnelManager{
+		Project:    "my-project",
+		Zone:       "us-west1-a",
+		Instance:   "vm",
+		RemotePort: 22,
+	}
+	u := m.tunnelURL("", 0)
+	require.Equal(t, URL_SCHEME, u.Scheme)
+	require.Equal(t, URL_HOST, u.Host)
+	require.Equal(t, URL_PATH_ROOT+"/"+CONNECT_ENDPOINT, u.Path)
+	require.Equal(t, "nic0", u.Query().Get("interface"))
+
+	// presenting a client certificate requires the mTLS relay
+	m.TLSConfig = &tls.Config{}
+	u = m.tunnelURL("sid", 10)
+	require.Equal(t, MTLS_URL_HOST, u.Host)
+	require.Equal(t, URL_PATH_ROOT+"/"+RECONNECT_ENDPOINT, u.Path)
+	require.Equal(t, "sid", u.Query().Get("sid"))
+	require.Equal(t, "10", u.Query().Get("ack"))
+	require.Equal(t, "us-west1-a", u.Query().Get("zone"))
+
+	// an explicit endpoint wins
+	m.TunnelHost = "localhost:8080"
+	require.Equal(t, "localhost:8080", m.tunnelURL("", 0).Host)
+}
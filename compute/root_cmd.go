@@ -0,0 +1,20 @@
+package compute
+
+import "github.com/spf13/cobra"
+
+var rootCmd = &cobra.Command{
+	Use: "compute",
+}
+
+var rootCmdInitDone = false
+
+func GetRootCmd() *cobra.Command {
+	if !rootCmdInitDone {
+		fs := rootCmd.PersistentFlags()
+		fs.String("project", "", "project id (default is the core/project property)")
+		fs.String("zone", "", "zone of the instance (default is the compute/zone property)")
+		registerStartIapTunnelCmd(rootCmd)
+		rootCmdInitDone = true
+	}
+	return rootCmd
+}
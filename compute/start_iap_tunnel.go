@@ -0,0 +1,214 @@
+package compute
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/gartnera/gcloud/auth"
+	"github.com/gartnera/gcloud/compute/iap"
+	"github.com/gartnera/gcloud/helpers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// listenInfo is printed to stdout once the tunnel is listening so scripts can wait
+// for it and discover the port
+type listenInfo struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+	Port    int    `json:"port,omitempty"`
+}
+
+// getProject returns --project or the core/project property
+func getProject(fs *pflag.FlagSet) (string, error) {
+	project, _ := fs.GetString("project")
+	if project == "" {
+		project = helpers.GetProperty("core", "project")
+	}
+	if project == "" {
+		project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	if project == "" {
+		return "", errors.New("--project is required (or set the core/project property)")
+	}
+	return project, nil
+}
+
+// getZone returns --zone or the compute/zone property
+func getZone(fs *pflag.FlagSet) (string, error) {
+	zone, _ := fs.GetString("zone")
+	if zone == "" {
+		zone = helpers.GetProperty("compute", "zone")
+	}
+	if zone == "" {
+		return "", errors.New("--zone is required (or set the compute/zone property)")
+	}
+	return zone, nil
+}
+
+// listen opens the local listener from --local-host-port or --unix-socket
+func listen(fs *pflag.FlagSet) (net.Listener, error) {
+	socketPath, _ := fs.GetString("unix-socket")
+	if socketPath != "" {
+		if fs.Changed("local-host-port") {
+			return nil, errors.New("only one of --local-host-port or --unix-socket may be set")
+		}
+		// remove a stale socket left behind by a previous run
+		if fi, err := os.Lstat(socketPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(socketPath)
+		}
+		lis, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to listen on %s: %w", socketPath, err)
+		}
+		return lis, nil
+	}
+	hostPort, _ := fs.GetString("local-host-port")
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --local-host-port %s: %w", hostPort, err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	lis, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %w", hostPort, err)
+	}
+	return lis, nil
+}
+
+// getTunnelManager returns a tunnel to target, which is an instance name or,
+// with --region, a host in a destination group
+func getTunnelManager(fs *pflag.FlagSet, target string, remotePort int) (*iap.TunnelManager, error) {
+	project, err := getProject(fs)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := auth.ClientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	m := &iap.TunnelManager{
+		Project:    project,
+		RemotePort: remotePort,
+		TLSConfig:  tlsConfig,
+	}
+	region, _ := fs.GetString("region")
+	if region == "" {
+		if fs.Changed("network") || fs.Changed("dest-group") {
+			return nil, errors.New("--network and --dest-group require --region")
+		}
+		m.Zone, err = getZone(fs)
+		if err != nil {
+			return nil, err
+		}
+		m.Instance = target
+		m.Interface, _ = fs.GetString("network-interface")
+		return m, nil
+	}
+	if fs.Changed("zone") || fs.Changed("network-interface") {
+		return nil, errors.New("--zone and --network-interface may not be used with --region")
+	}
+	network, _ := fs.GetString("network")
+	if network == "" {
+		return nil, errors.New("--network is required with --region")
+	}
+	m.Host = target
+	m.Region = region
+	m.Network = network
+	m.DestGroup, _ = fs.GetString("dest-group")
+	return m, nil
+}
+
+var startIapTunnelCmd = &cobra.Command{
+	Use:          "start-iap-tunnel INSTANCE|HOST PORT",
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fs := cmd.Flags()
+		remotePort, err := strconv.Atoi(args[1])
+		if err != nil || remotePort < 1 || remotePort > 65535 {
+			return fmt.Errorf("invalid port %s", args[1])
+		}
+		m, err := getTunnelManager(fs, args[0], remotePort)
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if listenOnStdin, _ := fs.GetBool("listen-on-stdin"); listenOnStdin {
+			if fs.Changed("local-host-port") || fs.Changed("unix-socket") {
+				return errors.New("--listen-on-stdin may not be used with --local-host-port or --unix-socket")
+			}
+			tunnel, err := m.StartTunnel(ctx)
+			if err != nil {
+				return err
+			}
+			return pipeStdio(ctx, tunnel, cmd.InOrStdin(), cmd.OutOrStdout())
+		}
+		lis, err := listen(fs)
+		if err != nil {
+			return err
+		}
+		info := listenInfo{
+			Network: lis.Addr().Network(),
+			Address: lis.Addr().String(),
+		}
+		if addr, ok := lis.Addr().(*net.TCPAddr); ok {
+			info.Port = addr.Port
+			fmt.Fprintf(cmd.ErrOrStderr(), "Listening on port [%d].\n", addr.Port)
+		} else {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Listening on [%s].\n", info.Address)
+		}
+		err = json.NewEncoder(cmd.OutOrStdout()).Encode(info)
+		if err != nil {
+			lis.Close()
+			return fmt.Errorf("unable to write listen address: %w", err)
+		}
+		err = m.Serve(ctx, lis)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.ErrOrStderr(), "Shutting down.")
+		return nil
+	},
+}
+
+// pipeStdio copies stdin to the tunnel and the tunnel to stdout until the remote
+// end closes, like the connections of the local listener
+func pipeStdio(ctx context.Context, tunnel io.ReadWriteCloser, stdin io.Reader, stdout io.Writer) error {
+	defer tunnel.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- iap.Pipe(tunnel, stdin, stdout)
+	}()
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errCh:
+		return err
+	}
+}
+
+func registerStartIapTunnelCmd(parent *cobra.Command) {
+	fs := startIapTunnelCmd.Flags()
+	fs.String("local-host-port", "localhost:0", "local address to listen on, port 0 picks an unused port")
+	fs.String("unix-socket", "", "listen on this unix socket rather than a local port")
+	fs.String("network-interface", "nic0", "network interface of the instance to connect to")
+	fs.String("region", "", "region of the destination group; INSTANCE is then the IP address or FQDN of a host outside of Compute Engine")
+	fs.String("network", "", "VPC network of the host (requires --region)")
+	fs.String("dest-group", "", "destination group of the host (requires --region)")
+	fs.Bool("listen-on-stdin", false, "tunnel a single connection over stdin and stdout (for ssh ProxyCommand)")
+	startIapTunnelCmd.SetFlagErrorFunc(helpers.FallbackOnUnknownFlag)
+	parent.AddCommand(startIapTunnelCmd)
+}
@@ -0,0 +1,45 @@
+package compute
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gartnera/gcloud/helpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeStdioHalfClose(t *testing.T) {
+	local, remote := net.Pipe()
+	go func() {
+		// read the whole request, then reply and close like a server would
+		buf := make([]byte, len("ping"))
+		_, _ = io.ReadFull(remote, buf)
+		_, _ = remote.Write(append(buf, []byte(" pong")...))
+		remote.Close()
+	}()
+	stdout := new(bytes.Buffer)
+	err := pipeStdio(context.Background(), local, strings.NewReader("ping"), stdout)
+	require.NoError(t, err)
+	require.Equal(t, "ping pong", stdout.String())
+}
+
+func TestPipeStdioCancel(t *testing.T) {
+	local, _ := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	stdin, _ := io.Pipe()
+	cancel()
+	err := pipeStdio(ctx, local, stdin, io.Discard)
+	require.NoError(t, err)
+}
+
+func TestStartIapTunnelUnknownFlag(t *testing.T) {
+	cmd := GetRootCmd()
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	cmd.SetArgs([]string{"start-iap-tunnel", "vm", "22", "--iap-tunnel-disable-connection-check"})
+	require.Equal(t, helpers.ErrFallback, cmd.Execute())
+}
@@ -3,11 +3,14 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/gartnera/gcloud/auth"
+	"github.com/gartnera/gcloud/helpers"
 	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
 	"gopkg.in/yaml.v3"
 )
 
@@ -17,38 +20,66 @@ type ConfigHelperOutputCredential struct {
 	TokenExpiry time.Time `json:"token_expiry" yaml:"token_expiry"`
 }
 
-type ConfigHelperOutput struct {
-	Credential *ConfigHelperOutputCredential `json:"credential" yaml:"credential"`
+type ConfigHelperOutputConfiguration struct {
+	ActiveConfiguration string             `json:"active_configuration" yaml:"active_configuration"`
+	Properties          helpers.Properties `json:"properties" yaml:"properties"`
 }
 
-type ExecCredential struct {
-	APIVersion string               `json:"apiVersion"`
-	Kind       string               `json:"kind"`
-	Status     ExecCredentialStatus `json:"status"`
+type ConfigHelperOutputSentinels struct {
+	ConfigSentinel string `json:"config_sentinel" yaml:"config_sentinel"`
 }
 
-type ExecCredentialStatus struct {
-	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
-	Token               string    `json:"token"`
+type ConfigHelperOutput struct {
+	Configuration *ConfigHelperOutputConfiguration `json:"configuration" yaml:"configuration"`
+	Credential    *ConfigHelperOutputCredential    `json:"credential" yaml:"credential"`
+	Sentinels     *ConfigHelperOutputSentinels     `json:"sentinels" yaml:"sentinels"`
+}
+
+// configHelperToken gets a token respecting --force-auth-refresh and --min-expiry
+// if they are defined on cmd
+func configHelperToken(cmd *cobra.Command) (*oauth2.Token, error) {
+	forceAuthRefresh, _ := cmd.Flags().GetBool("force-auth-refresh")
+	minExpiry, _ := cmd.Flags().GetDuration("min-expiry")
+	ts, err := auth.TokenSourceCtx(cmd.Context())
+	if err != nil {
+		return nil, fmt.Errorf("unable to get tokensource: %w", err)
+	}
+	ts.SetMinExpiry(minExpiry)
+	if forceAuthRefresh {
+		return ts.Refresh()
+	}
+	return ts.Token()
 }
 
 var configHelperCmd = &cobra.Command{
 	Use: "config-helper",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		outputFormat, _ := cmd.Flags().GetString("format")
-		ts, err := auth.TokenSource()
-		if err != nil {
-			return fmt.Errorf("unable to get tokensource: %w", err)
+		if isExecCredentialFormat(outputFormat) {
+			return runExecCredential(cmd, outputFormat)
 		}
-		token, err := ts.Token()
+		token, err := configHelperToken(cmd)
 		if err != nil {
 			return fmt.Errorf("unable to get token: %w", err)
 		}
+		props, err := helpers.LoadProperties()
+		if err != nil {
+			return fmt.Errorf("unable to load properties: %w", err)
+		}
+		idToken, _ := token.Extra("id_token").(string)
 		output := &ConfigHelperOutput{
+			Configuration: &ConfigHelperOutputConfiguration{
+				ActiveConfiguration: helpers.ActiveConfigName(),
+				Properties:          props,
+			},
 			Credential: &ConfigHelperOutputCredential{
 				AccessToken: token.AccessToken,
+				IDToken:     idToken,
 				TokenExpiry: token.Expiry,
 			},
+			Sentinels: &ConfigHelperOutputSentinels{
+				ConfigSentinel: filepath.Join(helpers.ConfigDir(), "config_sentinel"),
+			},
 		}
 		jsonEncoder := json.NewEncoder(cmd.OutOrStdout())
 		if strings.HasPrefix(outputFormat, "json") {
@@ -56,24 +87,6 @@ var configHelperCmd = &cobra.Command{
 		} else if outputFormat == "yaml" {
 			encoder := yaml.NewEncoder(cmd.OutOrStdout())
 			err = encoder.Encode(output)
-		} else if outputFormat == "client.authentication.k8s.io/v1beta1" {
-			outputv1 := &ExecCredential{
-				APIVersion: "client.authentication.k8s.io/v1beta1",
-				Kind:       "ExecCredential",
-				Status: ExecCredentialStatus{
-					Token:               token.AccessToken,
-					ExpirationTimestamp: token.Expiry,
-				}}
-			err = jsonEncoder.Encode(outputv1)
-		} else if outputFormat == "client.authentication.k8s.io/v1" {
-			outputv1 := &ExecCredential{
-				APIVersion: "client.authentication.k8s.io/v1",
-				Kind:       "ExecCredential",
-				Status: ExecCredentialStatus{
-					Token:               token.AccessToken,
-					ExpirationTimestamp: token.Expiry,
-				}}
-			err = jsonEncoder.Encode(outputv1)
 		} else {
 			return fmt.Errorf("invalid output format: %s", outputFormat)
 		}
@@ -83,6 +96,9 @@ var configHelperCmd = &cobra.Command{
 }
 
 func registerConfigHelperCmd(parent *cobra.Command) {
-	configHelperCmd.Flags().StringP("format", "o", "yaml", "output format")
+	fs := configHelperCmd.Flags()
+	fs.StringP("format", "o", "yaml", "output format")
+	fs.Bool("force-auth-refresh", false, "force a refresh of the credential even if it is still valid")
+	fs.Duration("min-expiry", 0, "refresh the credential if it expires within this duration (ex: 1h)")
 	parent.AddCommand(configHelperCmd)
 }
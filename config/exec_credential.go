@@ -0,0 +1,142 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gartnera/gcloud/auth"
+	"github.com/spf13/cobra"
+	"golang.org/x/oauth2"
+)
+
+// execInfoEnv is set by kubectl when it runs an exec credential plugin
+const execInfoEnv = "KUBERNETES_EXEC_INFO"
+
+const execCredentialAPIGroup = "client.authentication.k8s.io/"
+
+type ExecCredential struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Spec       *ExecCredentialSpec   `json:"spec,omitempty"`
+	Status     *ExecCredentialStatus `json:"status,omitempty"`
+}
+
+type ExecCredentialSpec struct {
+	Cluster     *ExecCredentialCluster `json:"cluster,omitempty"`
+	Interactive bool                   `json:"interactive"`
+}
+
+// ExecCredentialCluster is only provided when provideClusterInfo is set in the kubeconfig
+type ExecCredentialCluster struct {
+	Server                   string          `json:"server"`
+	TLSServerName            string          `json:"tls-server-name,omitempty"`
+	CertificateAuthorityData string          `json:"certificate-authority-data,omitempty"`
+	ProxyURL                 string          `json:"proxy-url,omitempty"`
+	Config                   json.RawMessage `json:"config,omitempty"`
+}
+
+type ExecCredentialStatus struct {
+	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+	Token               string    `json:"token"`
+}
+
+// ExecClusterConfig is read from the client.authentication.k8s.io/exec extension
+// of the kubeconfig cluster and allows selecting the identity per cluster
+type ExecClusterConfig struct {
+	ImpersonateServiceAccount string `json:"impersonate-service-account,omitempty"`
+	ApplicationCredentials    string `json:"application-credentials,omitempty"`
+}
+
+func isExecCredentialFormat(format string) bool {
+	return strings.HasPrefix(format, execCredentialAPIGroup)
+}
+
+func newExecCredential(apiVersion string, token *oauth2.Token) *ExecCredential {
+	return &ExecCredential{
+		APIVersion: apiVersion,
+		Kind:       "ExecCredential",
+		Status: &ExecCredentialStatus{
+			Token:               token.AccessToken,
+			ExpirationTimestamp: token.Expiry,
+		},
+	}
+}
+
+// readExecInfo returns nil if we were not invoked by kubectl
+func readExecInfo() (*ExecCredential, error) {
+	execInfoStr := os.Getenv(execInfoEnv)
+	if execInfoStr == "" {
+		return nil, nil
+	}
+	execInfo := &ExecCredential{}
+	err := json.Unmarshal([]byte(execInfoStr), execInfo)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %w", execInfoEnv, err)
+	}
+	if !isExecCredentialFormat(execInfo.APIVersion) {
+		return nil, fmt.Errorf("unsupported %s apiVersion: %s", execInfoEnv, execInfo.APIVersion)
+	}
+	return execInfo, nil
+}
+
+// applyExecClusterConfig selects the identity configured in the cluster extension.
+// Explicit flags take precedence. The service account is per cluster so it
+// also takes precedence over GOOGLE_IMPERSONATE_SERVICE_ACCOUNT, while
+// GOOGLE_APPLICATION_CREDENTIALS takes precedence over the credentials.
+func applyExecClusterConfig(execInfo *ExecCredential) error {
+	if execInfo.Spec == nil || execInfo.Spec.Cluster == nil || len(execInfo.Spec.Cluster.Config) == 0 {
+		return nil
+	}
+	clusterConfig := &ExecClusterConfig{}
+	err := json.Unmarshal(execInfo.Spec.Cluster.Config, clusterConfig)
+	if err != nil {
+		return fmt.Errorf("unable to decode cluster exec config: %w", err)
+	}
+	if clusterConfig.ImpersonateServiceAccount != "" && auth.ImpersonateServiceAccount == "" {
+		auth.ImpersonateServiceAccount = clusterConfig.ImpersonateServiceAccount
+	}
+	if clusterConfig.ApplicationCredentials != "" && os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
+		err = os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", clusterConfig.ApplicationCredentials)
+		if err != nil {
+			return fmt.Errorf("unable to set application credentials: %w", err)
+		}
+	}
+	return nil
+}
+
+// runExecCredential writes an ExecCredential for kubectl. apiVersion is only used
+// if kubectl did not provide KUBERNETES_EXEC_INFO.
+func runExecCredential(cmd *cobra.Command, apiVersion string) error {
+	execInfo, err := readExecInfo()
+	if err != nil {
+		return err
+	}
+	interactive := false
+	if execInfo != nil {
+		apiVersion = execInfo.APIVersion
+		if execInfo.Spec != nil {
+			interactive = execInfo.Spec.Interactive
+		}
+		err = applyExecClusterConfig(execInfo)
+		if err != nil {
+			return err
+		}
+	}
+
+	token, err := configHelperToken(cmd)
+	if err != nil && interactive {
+		fmt.Fprintf(cmd.ErrOrStderr(), "unable to get token, attempting login: %v\n", err)
+		err = auth.EnvApplicationCredentialManager().AutoDetectLogin(cmd.Context(), "")
+		if err != nil {
+			return fmt.Errorf("unable to login: %w", err)
+		}
+		token, err = configHelperToken(cmd)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get token: %w", err)
+	}
+	return json.NewEncoder(cmd.OutOrStdout()).Encode(newExecCredential(apiVersion, token))
+}
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gartnera/gcloud/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyExecClusterConfig(t *testing.T) {
+	flag := auth.ImpersonateServiceAccount
+	t.Cleanup(func() {
+		auth.ImpersonateServiceAccount = flag
+	})
+	execInfo := &ExecCredential{
+		Spec: &ExecCredentialSpec{
+			Cluster: &ExecCredentialCluster{
+				Config: json.RawMessage(`{"impersonate-service-account": "cluster@my-project.iam.gserviceaccount.com"}`),
+			},
+		},
+	}
+	tests := []struct {
+		flag string
+		env  string
+		want string
+	}{
+		{"", "", "cluster@my-project.iam.gserviceaccount.com"},
+		{"", "env@my-project.iam.gserviceaccount.com", "cluster@my-project.iam.gserviceaccount.com"},
+		{"flag@my-project.iam.gserviceaccount.com", "env@my-project.iam.gserviceaccount.com", "flag@my-project.iam.gserviceaccount.com"},
+	}
+	for _, tt := range tests {
+		auth.ImpersonateServiceAccount = tt.flag
+		t.Setenv("GOOGLE_IMPERSONATE_SERVICE_ACCOUNT", tt.env)
+		require.NoError(t, applyExecClusterConfig(execInfo))
+		require.Equal(t, tt.want, auth.ImpersonatedServiceAccount(), "flag %q env %q", tt.flag, tt.env)
+	}
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/gartnera/gcloud/auth"
+	"github.com/spf13/cobra"
+)
+
+// GkeAuthPluginName is the name kubectl uses to invoke the GKE exec credential plugin
+const GkeAuthPluginName = "gke-gcloud-auth-plugin"
+
+var gkeAuthPluginCmd = &cobra.Command{
+	Use:          GkeAuthPluginName,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if printVersion, _ := cmd.Flags().GetBool("version"); printVersion {
+			version := "(devel)"
+			if info, ok := debug.ReadBuildInfo(); ok {
+				version = info.Main.Version
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), version)
+			return nil
+		}
+		if useEdgeCloud, _ := cmd.Flags().GetBool("use_edge_cloud"); useEdgeCloud {
+			return errors.New("--use_edge_cloud is not supported")
+		}
+		if impersonate, _ := cmd.Flags().GetString("impersonate-service-account"); impersonate != "" {
+			auth.ImpersonateServiceAccount = impersonate
+		}
+		// like the upstream plugin, default to v1beta1 if kubectl does not tell us what it wants
+		return runExecCredential(cmd, "client.authentication.k8s.io/v1beta1")
+	},
+}
+
+var gkeAuthPluginCmdInitDone = false
+
+// GetGkeAuthPluginCmd returns a standalone command that behaves like the upstream
+// gke-gcloud-auth-plugin binary
+func GetGkeAuthPluginCmd() *cobra.Command {
+	if !gkeAuthPluginCmdInitDone {
+		fs := gkeAuthPluginCmd.Flags()
+		fs.Bool("version", false, "print the version and exit")
+		// all credentials are application default credentials here, so this is accepted for compatibility only
+		fs.Bool("use_application_default_credentials", false, "use application default credentials")
+		fs.Bool("use_edge_cloud", false, "authenticate to a GDC edge cloud cluster")
+		fs.String("project", "", "edge cloud project")
+		fs.String("location", "", "edge cloud location")
+		fs.String("cluster", "", "edge cloud cluster")
+		fs.String("impersonate-service-account", "", "service account email to impersonate")
+		gkeAuthPluginCmdInitDone = true
+	}
+	return gkeAuthPluginCmd
+}
@@ -1,17 +1,16 @@
 package container
 
 import (
-	"encoding/base64"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"sort"
+	"strings"
 
-	container "cloud.google.com/go/container/apiv1"
 	"github.com/gartnera/gcloud/auth"
+	"github.com/gartnera/gcloud/helpers"
 	"github.com/spf13/cobra"
-	"google.golang.org/api/option"
+	"github.com/spf13/pflag"
 	containerpb "google.golang.org/genproto/googleapis/container/v1"
-	clientcmd "k8s.io/client-go/tools/clientcmd"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
@@ -20,91 +19,420 @@ var clustersCmd = &cobra.Command{
 }
 
 var clustersGetCredentialsCmd = &cobra.Command{
-	Use:  "get-credentials",
-	Args: cobra.ExactArgs(1),
+	Use:  "get-credentials [NAME]",
+	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if all, _ := cmd.Flags().GetBool("all"); all {
+			if len(args) != 0 {
+				return errors.New("a cluster name may not be given with --all")
+			}
+			for _, flag := range []string{"via-iap-bastion", "via-iap-dest-group"} {
+				if value, _ := cmd.Flags().GetString(flag); value != "" {
+					return fmt.Errorf("--%s may not be used with --all", flag)
+				}
+			}
+			return getAllCredentials(cmd)
+		}
+		if len(args) != 1 {
+			return errors.New("cluster name is required (or use --all)")
+		}
 		ctx := cmd.Context()
 		cFlags, err := getCommonFlags(cmd.Flags())
 		if err != nil {
 			return err
 		}
-		// for whatever reason, option.WithTokenSource(auth.TokenSource()) does not work here
-		ts, err := auth.TokenSource()
+		client, ts, err := newClusterManagerClient(ctx)
 		if err != nil {
-			return fmt.Errorf("unable to get token source: %w", err)
+			return err
 		}
-		client, err := container.NewClusterManagerClient(ctx, option.WithTokenSource(ts))
+		defer client.Close()
+		clusterName := args[0]
+		gName, cluster, err := cFlags.getCluster(ctx, client, clusterName)
 		if err != nil {
-			return fmt.Errorf("unable to get container client: %w", err)
+			return err
 		}
-		clusterName := args[0]
-		var gName string
-		var kName string
-		if cFlags.region != "" {
-			gName = fmt.Sprintf("projects/%s/locations/%s/clusters/%s", cFlags.project, cFlags.region, clusterName)
-			kName = fmt.Sprintf("gke_%s_%s_%s", cFlags.project, cFlags.region, clusterName)
-		} else {
-			gName = fmt.Sprintf("projects/%s/zones/%s/clusters/%s", cFlags.project, cFlags.zone, clusterName)
-			kName = fmt.Sprintf("gke_%s_%s_%s", cFlags.project, cFlags.zone, clusterName)
+
+		endpointMode, err := getEndpointMode(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		iapProxy, err := getIapProxyArgs(cmd.Flags(), cFlags.project, cluster)
+		if err != nil {
+			return err
+		}
+		// the point of the proxy is to reach the private endpoint
+		if iapProxy != nil && !endpointModeSet(cmd.Flags()) {
+			endpointMode = endpointInternal
+		}
+		kubeCluster, err := newKubeConfigCluster(ctx, cmd.ErrOrStderr(), ts, cluster, gName, endpointMode)
+		if err != nil {
+			return err
+		}
+		if iapProxy != nil {
+			kubeCluster.ProxyURL = iapProxy.proxyURL()
+		}
+		contextNameTemplate, _ := cmd.Flags().GetString("context-name")
+		kName := renderContextName(contextNameTemplate, cFlags.project, cFlags.location, clusterName)
+		err = writeCredentials(cmd, kName, gName, kubeCluster)
+		if err != nil {
+			return err
+		}
+		if iapProxy != nil {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Start the proxy before using kubectl:\n  %s\n", iapProxy.proxyCommand())
+		}
+		return nil
+	},
+}
+
+// writeCredentials writes a context using the GKE exec plugin for kubeCluster and
+// makes it the current context. gName is the full resource name of the GKE
+// cluster if kubeCluster is one.
+func writeCredentials(cmd *cobra.Command, kName string, gName string, kubeCluster *clientcmdapi.Cluster) error {
+	execSelf, _ := cmd.Flags().GetBool("exec-self")
+	execConfig, err := newExecConfig(execSelf, auth.ImpersonatedServiceAccount())
+	if err != nil {
+		return err
+	}
+	explicitKubeConfig, _ := cmd.Flags().GetString("kubeconfig")
+	err = modifyKubeConfig(explicitKubeConfig, func(kubeConfig *clientcmdapi.Config, files []string) error {
+		setKubeConfigEntry(kubeConfig, files, kName, gName, kubeCluster, &clientcmdapi.AuthInfo{Exec: execConfig})
+		kubeConfig.CurrentContext = kName
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "kubeconfig entry generated for %s.\n", kName)
+	return nil
+}
+
+var clusterColumns = []helpers.Column{
+	{Path: "name"},
+	{Path: "location"},
+	{Path: "currentMasterVersion", Label: "MASTER_VERSION"},
+	{Path: "endpoint", Label: "MASTER_IP"},
+	{Path: "nodePools[0].config.machineType", Label: "MACHINE_TYPE"},
+	{Path: "currentNodeVersion", Label: "NODE_VERSION"},
+	{Path: "currentNodeCount", Label: "NUM_NODES"},
+	{Path: "status"},
+}
+
+var clustersListCmd = &cobra.Command{
+	Use:          "list",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		cFlags, err := getCommonFlags(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		client, _, err := newClusterManagerClient(ctx)
+		if err != nil {
+			return err
 		}
-		req := &containerpb.GetClusterRequest{
-			Name: gName,
+		defer client.Close()
+		req := &containerpb.ListClustersRequest{
+			Parent: cFlags.listParent(),
 		}
-		cluster, err := client.GetCluster(ctx, req)
+		res, err := client.ListClusters(ctx, req)
 		if err != nil {
-			return fmt.Errorf("unable to get cluster %s: %w", clusterName, err)
+			return fmt.Errorf("unable to list clusters: %w", err)
 		}
+		if len(res.MissingZones) > 0 {
+			fmt.Fprintf(cmd.ErrOrStderr(), "WARNING: the following locations did not respond: %s\n", strings.Join(res.MissingZones, ", "))
+		}
+		var resources []helpers.Resource
+		for _, cluster := range res.Clusters {
+			resource, err := helpers.ToResource(cluster)
+			if err != nil {
+				return err
+			}
+			resources = append(resources, resource)
+		}
+		return helpers.PrintResources(cmd, resources, clusterColumns)
+	},
+}
 
-		kubeConfigPath := os.Getenv("KUBECONFIG")
-		if kubeConfigPath == "" {
-			kubeConfigPath = os.ExpandEnv("${HOME}/.kube/config")
+var clustersDescribeCmd = &cobra.Command{
+	Use:          "describe NAME",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		cFlags, err := getCommonFlags(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		client, _, err := newClusterManagerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		_, cluster, err := cFlags.getCluster(ctx, client, args[0])
+		if err != nil {
+			return err
+		}
+		resource, err := helpers.ToResource(cluster)
+		if err != nil {
+			return err
 		}
-		kubeConfigDir := filepath.Dir(kubeConfigPath)
-		_ = os.MkdirAll(kubeConfigDir, os.ModeDir)
+		return helpers.PrintResource(cmd, resource)
+	},
+}
 
-		var kubeConfig *clientcmdapi.Config
-		if _, err = os.Stat(kubeConfigPath); os.IsNotExist(err) {
-			kubeConfig, err = clientcmd.Load([]byte{})
+var clustersResizeCmd = &cobra.Command{
+	Use:          "resize NAME",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		fs := cmd.Flags()
+		if !fs.Changed("num-nodes") {
+			return errors.New("--num-nodes is required")
+		}
+		numNodes, _ := fs.GetInt32("num-nodes")
+		cFlags, err := getCommonFlags(fs)
+		if err != nil {
+			return err
+		}
+		client, _, err := newClusterManagerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		gName, cluster, err := cFlags.clusterPath(ctx, client, args[0])
+		if err != nil {
+			return err
+		}
+		nodePool, _ := fs.GetString("node-pool")
+		if nodePool == "" {
+			if cluster == nil {
+				cluster, err = client.GetCluster(ctx, &containerpb.GetClusterRequest{Name: gName})
+				if err != nil {
+					return fmt.Errorf("unable to get cluster %s: %w", args[0], err)
+				}
+			}
+			if len(cluster.NodePools) != 1 {
+				return errors.New("--node-pool is required for clusters with more than one node pool")
+			}
+			nodePool = cluster.NodePools[0].Name
+		}
+		err = confirm(cmd, fmt.Sprintf("Pool %s for cluster %s will be resized to %d node(s) in each of the cluster's zones.", nodePool, args[0], numNodes))
+		if err != nil {
+			return err
+		}
+		req := &containerpb.SetNodePoolSizeRequest{
+			Name:      fmt.Sprintf("%s/nodePools/%s", gName, nodePool),
+			NodeCount: numNodes,
+		}
+		op, err := client.SetNodePoolSize(ctx, req)
+		if err != nil {
+			return fmt.Errorf("unable to resize node pool %s: %w", nodePool, err)
+		}
+		return finishOperation(ctx, cmd, client, cFlags.project, op)
+	},
+}
+
+var clustersUpgradeCmd = &cobra.Command{
+	Use:          "upgrade NAME",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		fs := cmd.Flags()
+		master, _ := fs.GetBool("master")
+		nodePool, _ := fs.GetString("node-pool")
+		if master && nodePool != "" {
+			return errors.New("only one of --master or --node-pool may be set")
+		}
+		version, _ := fs.GetString("cluster-version")
+		cFlags, err := getCommonFlags(fs)
+		if err != nil {
+			return err
+		}
+		client, _, err := newClusterManagerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		gName, cluster, err := cFlags.clusterPath(ctx, client, args[0])
+		if err != nil {
+			return err
+		}
+
+		var op *containerpb.Operation
+		if master {
+			// "-" is the default version
+			if version == "" {
+				version = "-"
+			}
+			err = confirm(cmd, fmt.Sprintf("Master of cluster %s will be upgraded to version %s.", args[0], version))
+			if err != nil {
+				return err
+			}
+			op, err = client.UpdateMaster(ctx, &containerpb.UpdateMasterRequest{Name: gName, MasterVersion: version})
 			if err != nil {
-				return fmt.Errorf("unable to initialize kubeconfig: %w", err)
+				return fmt.Errorf("unable to upgrade master of cluster %s: %w", args[0], err)
 			}
-		} else {
-			kubeConfig, err = clientcmd.LoadFromFile(kubeConfigPath)
+			return finishOperation(ctx, cmd, client, cFlags.project, op)
+		}
+
+		if cluster == nil {
+			cluster, err = client.GetCluster(ctx, &containerpb.GetClusterRequest{Name: gName})
 			if err != nil {
-				return fmt.Errorf("unable to load kubeconfig: %w", err)
+				return fmt.Errorf("unable to get cluster %s: %w", args[0], err)
+			}
+		}
+		var pool *containerpb.NodePool
+		for _, candidate := range cluster.NodePools {
+			if candidate.Name == nodePool || (nodePool == "" && len(cluster.NodePools) == 1) {
+				pool = candidate
+			}
+		}
+		if pool == nil {
+			if nodePool == "" {
+				return errors.New("--node-pool is required for clusters with more than one node pool")
 			}
+			return fmt.Errorf("node pool %s not found in cluster %s", nodePool, args[0])
+		}
+		// nodes are upgraded to the master version by default
+		if version == "" {
+			version = cluster.CurrentMasterVersion
 		}
-		caCertificateDecoded, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClusterCaCertificate)
+		err = confirm(cmd, fmt.Sprintf("Nodes of pool %s in cluster %s will be upgraded from version %s to %s.", pool.Name, args[0], pool.Version, version))
 		if err != nil {
-			return fmt.Errorf("unable to decode ca certificate: %w", err)
+			return err
 		}
-		kubeConfig.Clusters[kName] = &clientcmdapi.Cluster{
-			Server:                   fmt.Sprintf("https://%s", cluster.Endpoint),
-			CertificateAuthorityData: caCertificateDecoded,
+		req := &containerpb.UpdateNodePoolRequest{
+			Name:        fmt.Sprintf("%s/nodePools/%s", gName, pool.Name),
+			NodeVersion: version,
+			ImageType:   pool.GetConfig().GetImageType(),
 		}
-		kubeConfig.AuthInfos[kName] = &clientcmdapi.AuthInfo{
-			Exec: &clientcmdapi.ExecConfig{
-				Command:         "gke-gcloud-auth-plugin",
-				APIVersion:      "client.authentication.k8s.io/v1beta1",
-				InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
-			},
+		op, err = client.UpdateNodePool(ctx, req)
+		if err != nil {
+			return fmt.Errorf("unable to upgrade node pool %s: %w", pool.Name, err)
 		}
-		kubeConfig.Contexts[kName] = &clientcmdapi.Context{
-			Cluster:  kName,
-			AuthInfo: kName,
+		return finishOperation(ctx, cmd, client, cFlags.project, op)
+	},
+}
+
+// endpointModeSet reports if any of the endpoint flags were set
+func endpointModeSet(fs *pflag.FlagSet) bool {
+	return fs.Changed("internal-ip") || fs.Changed("dns-endpoint") || fs.Changed("auto-endpoint")
+}
+
+func getEndpointMode(fs *pflag.FlagSet) (string, error) {
+	mode := endpointPublic
+	selected := 0
+	for flag, flagMode := range map[string]string{
+		"internal-ip":   endpointInternal,
+		"dns-endpoint":  endpointDNS,
+		"auto-endpoint": endpointAuto,
+	} {
+		if set, _ := fs.GetBool(flag); set {
+			mode = flagMode
+			selected++
 		}
-		kubeConfig.CurrentContext = kName
+	}
+	if selected > 1 {
+		return "", errors.New("only one of --internal-ip, --dns-endpoint, or --auto-endpoint may be set")
+	}
+	return mode, nil
+}
 
-		err = clientcmd.WriteToFile(*kubeConfig, kubeConfigPath)
+// repairKubeConfig points the contexts written by get-credentials (with any
+// --context-name) at the current auth plugin (or this binary with execSelf).
+// It returns the names of the repaired contexts.
+func repairKubeConfig(kubeConfig *clientcmdapi.Config, execSelf bool) ([]string, error) {
+	var repaired []string
+	for contextName, kubeContext := range kubeConfig.Contexts {
+		authInfo, ok := kubeConfig.AuthInfos[kubeContext.AuthInfo]
+		if !ok || !isGkeAuthInfo(authInfo) {
+			continue
+		}
+		execConfig, err := newExecConfig(execSelf, execImpersonation(authInfo))
 		if err != nil {
-			return fmt.Errorf("unable to write kubeconfig: %w", err)
+			return nil, err
+		}
+		// keep any per cluster identity configured via the environment
+		if authInfo.Exec != nil {
+			var env []clientcmdapi.ExecEnvVar
+			for _, envVar := range authInfo.Exec.Env {
+				if envVar.Name != impersonateEnv {
+					env = append(env, envVar)
+				}
+			}
+			execConfig.Env = append(env, execConfig.Env...)
 		}
+		authInfo.AuthProvider = nil
+		authInfo.Exec = execConfig
+		repaired = append(repaired, contextName)
+	}
+	sort.Strings(repaired)
+	return repaired, nil
+}
 
-		return nil
+var clustersRepairKubeconfigCmd = &cobra.Command{
+	Use:          "repair-kubeconfig",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		execSelf, _ := cmd.Flags().GetBool("exec-self")
+		explicitKubeConfig, _ := cmd.Flags().GetString("kubeconfig")
+		return modifyKubeConfig(explicitKubeConfig, func(kubeConfig *clientcmdapi.Config, files []string) error {
+			repaired, err := repairKubeConfig(kubeConfig, execSelf)
+			if err != nil {
+				return err
+			}
+			for _, contextName := range repaired {
+				fmt.Fprintf(cmd.ErrOrStderr(), "repaired %s\n", contextName)
+			}
+			return nil
+		})
 	},
 }
 
+// addKubeConfigFlags adds the flags used by writeCredentials
+func addKubeConfigFlags(fs *pflag.FlagSet) {
+	fs.Bool("exec-self", false, "authenticate with this binary (config config-helper) rather than gke-gcloud-auth-plugin from the PATH")
+	fs.String("kubeconfig", "", "kubeconfig file to update (default is the first file in $KUBECONFIG or ~/.kube/config)")
+}
+
 func registerConfigHelperCmd(parent *cobra.Command) {
+	fs := clustersGetCredentialsCmd.Flags()
+	addKubeConfigFlags(fs)
+	fs.String("context-name", defaultContextNameTemplate, "context name template, {project}, {location}, and {cluster} are replaced")
+	fs.Bool("internal-ip", false, "use the internal ip of the control plane (private clusters)")
+	fs.Bool("dns-endpoint", false, "use the dns based endpoint of the control plane")
+	fs.Bool("auto-endpoint", false, "pick the endpoint based on the cluster configuration and where we are running")
+	addIapProxyFlags(fs)
+	fs.Bool("all", false, "write contexts for all clusters in the projects without changing the current context")
+	fs.StringSlice("projects", nil, "projects to sync with --all (default is the current project)")
+	fs.Bool("all-projects", false, "sync clusters in every project the caller can list with --all")
+	fs.Int("parallelism", 8, "maximum number of concurrent api requests with --all")
+	fs.Bool("prune", false, "remove contexts for clusters which no longer exist in the synced projects with --all")
 	clustersCmd.AddCommand(clustersGetCredentialsCmd)
+	helpers.AddFormatFlags(clustersListCmd.Flags(), true)
+	clustersCmd.AddCommand(clustersListCmd)
+	helpers.AddFormatFlags(clustersDescribeCmd.Flags(), false)
+	clustersCmd.AddCommand(clustersDescribeCmd)
+	fs = clustersResizeCmd.Flags()
+	fs.String("node-pool", "", "node pool to resize (required if the cluster has more than one)")
+	fs.Int32("num-nodes", 0, "number of nodes per zone")
+	fs.BoolP("quiet", "q", false, "do not prompt for confirmation")
+	addAsyncFlag(clustersResizeCmd)
+	clustersResizeCmd.SetFlagErrorFunc(helpers.FallbackOnUnknownFlag)
+	clustersCmd.AddCommand(clustersResizeCmd)
+	fs = clustersUpgradeCmd.Flags()
+	fs.Bool("master", false, "upgrade the control plane rather than the nodes")
+	fs.String("node-pool", "", "node pool to upgrade (required if the cluster has more than one)")
+	fs.String("cluster-version", "", "version to upgrade to (default is the master version for nodes and the default version for the master)")
+	fs.BoolP("quiet", "q", false, "do not prompt for confirmation")
+	addAsyncFlag(clustersUpgradeCmd)
+	clustersUpgradeCmd.SetFlagErrorFunc(helpers.FallbackOnUnknownFlag)
+	clustersCmd.AddCommand(clustersUpgradeCmd)
+	addKubeConfigFlags(clustersRepairKubeconfigCmd.Flags())
+	clustersCmd.AddCommand(clustersRepairKubeconfigCmd)
 	parent.AddCommand(clustersCmd)
 }
@@ -0,0 +1,261 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gartnera/gcloud/auth"
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// syncedCluster is a cluster which will be written to the kubeconfig by get-credentials --all
+type syncedCluster struct {
+	project     string
+	cluster     *containerpb.Cluster
+	kubeCluster *clientcmdapi.Cluster
+	err         error
+}
+
+// listAllProjects returns the ids of all active projects the caller can see
+func listAllProjects(ctx context.Context, ts *auth.CachingTokenSource) ([]string, error) {
+	opts, err := auth.ClientOptions(ts, "https://cloudresourcemanager.googleapis.com/")
+	if err != nil {
+		return nil, err
+	}
+	svc, err := cloudresourcemanager.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get resource manager client: %w", err)
+	}
+	var projects []string
+	err = svc.Projects.List().Filter("lifecycleState:ACTIVE").Pages(ctx, func(res *cloudresourcemanager.ListProjectsResponse) error {
+		for _, project := range res.Projects {
+			projects = append(projects, project.ProjectId)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list projects: %w", err)
+	}
+	sort.Strings(projects)
+	return projects, nil
+}
+
+// getAllCredentials implements get-credentials --all. Clusters are listed and
+// resolved concurrently, then all contexts are written in a single kubeconfig update.
+func getAllCredentials(cmd *cobra.Command) error {
+	ctx := cmd.Context()
+	fs := cmd.Flags()
+	client, ts, err := newClusterManagerClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	projects, _ := fs.GetStringSlice("projects")
+	allProjects, _ := fs.GetBool("all-projects")
+	if allProjects && len(projects) != 0 {
+		return errors.New("only one of --projects or --all-projects may be set")
+	}
+	if allProjects {
+		projects, err = listAllProjects(ctx, ts)
+		if err != nil {
+			return err
+		}
+	} else if len(projects) == 0 {
+		cFlags, err := getCommonFlags(fs)
+		if err != nil {
+			return err
+		}
+		projects = []string{cFlags.project}
+	}
+	endpointMode, err := getEndpointMode(fs)
+	if err != nil {
+		return err
+	}
+	parallelism, _ := fs.GetInt("parallelism")
+	if parallelism < 1 {
+		return errors.New("--parallelism must be at least 1")
+	}
+
+	// list the clusters in each project
+	projectClusters := make([][]*containerpb.Cluster, len(projects))
+	projectErrs := make([]error, len(projects))
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(parallelism)
+	for i, project := range projects {
+		i, project := i, project
+		g.Go(func() error {
+			req := &containerpb.ListClustersRequest{
+				Parent: fmt.Sprintf("projects/%s/locations/-", project),
+			}
+			res, err := client.ListClusters(gCtx, req)
+			if err != nil {
+				projectErrs[i] = err
+				return nil
+			}
+			projectClusters[i] = res.Clusters
+			if len(res.MissingZones) > 0 {
+				// we can't tell which clusters are gone if some locations are unavailable
+				projectErrs[i] = fmt.Errorf("locations unavailable: %s", strings.Join(res.MissingZones, ", "))
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	// resolve the endpoint of each cluster
+	var clusters []*syncedCluster
+	for i, project := range projects {
+		for _, cluster := range projectClusters[i] {
+			clusters = append(clusters, &syncedCluster{project: project, cluster: cluster})
+		}
+	}
+	g, gCtx = errgroup.WithContext(ctx)
+	g.SetLimit(parallelism)
+	for _, c := range clusters {
+		c := c
+		g.Go(func() error {
+			gName := fmt.Sprintf("projects/%s/locations/%s/clusters/%s", c.project, c.cluster.Location, c.cluster.Name)
+			c.kubeCluster, c.err = newKubeConfigCluster(gCtx, cmd.ErrOrStderr(), ts, c.cluster, gName, endpointMode)
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	var failed []string
+	// only prune projects which were listed completely
+	prunable := map[string]bool{}
+	for i, project := range projects {
+		if projectErrs[i] != nil {
+			fmt.Fprintf(cmd.ErrOrStderr(), "WARNING: unable to list clusters in project %s: %v\n", project, projectErrs[i])
+			failed = append(failed, project)
+			continue
+		}
+		prunable[project] = true
+	}
+	contextNameTemplate, _ := fs.GetString("context-name")
+	// clusters and servers which still exist, contexts referring to either are kept
+	existing := map[string]bool{}
+	for _, c := range clusters {
+		existing[fmt.Sprintf("projects/%s/locations/%s/clusters/%s", c.project, c.cluster.Location, c.cluster.Name)] = true
+		for _, endpoint := range []string{c.cluster.Endpoint, c.cluster.GetPrivateClusterConfig().GetPrivateEndpoint()} {
+			if endpoint != "" {
+				existing["https://"+endpoint] = true
+			}
+		}
+		if c.kubeCluster != nil {
+			existing[c.kubeCluster.Server] = true
+		}
+		if c.err != nil {
+			fmt.Fprintf(cmd.ErrOrStderr(), "WARNING: unable to get endpoint of cluster %s in project %s: %v\n", c.cluster.Name, c.project, c.err)
+			failed = append(failed, fmt.Sprintf("%s/%s", c.project, c.cluster.Name))
+		}
+	}
+
+	execSelf, _ := fs.GetBool("exec-self")
+	execConfig, err := newExecConfig(execSelf, auth.ImpersonatedServiceAccount())
+	if err != nil {
+		return err
+	}
+	prune, _ := fs.GetBool("prune")
+	explicitKubeConfig, _ := fs.GetString("kubeconfig")
+	var written, pruned []string
+	err = modifyKubeConfig(explicitKubeConfig, func(kubeConfig *clientcmdapi.Config, files []string) error {
+		for _, c := range clusters {
+			if c.err != nil {
+				continue
+			}
+			kName := renderContextName(contextNameTemplate, c.project, c.cluster.Location, c.cluster.Name)
+			gName := fmt.Sprintf("projects/%s/locations/%s/clusters/%s", c.project, c.cluster.Location, c.cluster.Name)
+			// each context gets its own copy so they can be edited independently later
+			authInfo := &clientcmdapi.AuthInfo{Exec: execConfig.DeepCopy()}
+			setKubeConfigEntry(kubeConfig, files, kName, gName, c.kubeCluster, authInfo)
+			written = append(written, kName)
+		}
+		if prune {
+			pruned = pruneKubeConfig(kubeConfig, prunable, existing)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range written {
+		fmt.Fprintf(cmd.ErrOrStderr(), "updated context %s\n", name)
+	}
+	for _, name := range pruned {
+		fmt.Fprintf(cmd.ErrOrStderr(), "removed context %s\n", name)
+	}
+	// inaccessible projects are expected when enumerating everything
+	if len(failed) > 0 && !allProjects {
+		return fmt.Errorf("unable to sync %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// contextCluster returns the full resource name of the GKE cluster a context
+// was written for. Contexts written by python gcloud are only recognized by
+// their gke_{project}_{location}_{cluster} name.
+func contextCluster(name string, kubeContext *clientcmdapi.Context) string {
+	if gName := contextGkeCluster(kubeContext); gName != "" {
+		return gName
+	}
+	parts := strings.SplitN(name, "_", 4)
+	if len(parts) != 4 || parts[0] != "gke" {
+		return ""
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/clusters/%s", parts[1], parts[2], parts[3])
+}
+
+// pruneKubeConfig removes contexts written by get-credentials for clusters in
+// the synced projects which no longer exist. Contexts are matched by the cluster
+// they were written for and by their server, not by name, so any --context-name
+// works. existing holds the resource names and servers of the existing clusters.
+// The cluster and user entries are removed as well if no other context uses them.
+func pruneKubeConfig(kubeConfig *clientcmdapi.Config, projects map[string]bool, existing map[string]bool) []string {
+	var pruned []string
+	var removed []*clientcmdapi.Context
+	for name, kubeContext := range kubeConfig.Contexts {
+		gName := contextCluster(name, kubeContext)
+		parts := strings.Split(gName, "/")
+		if len(parts) != 6 || !projects[parts[1]] || existing[gName] {
+			continue
+		}
+		if cluster, ok := kubeConfig.Clusters[kubeContext.Cluster]; ok && existing[cluster.Server] {
+			continue
+		}
+		// leave contexts alone which we did not write
+		if authInfo, ok := kubeConfig.AuthInfos[kubeContext.AuthInfo]; ok && !isGkeAuthInfo(authInfo) {
+			continue
+		}
+		delete(kubeConfig.Contexts, name)
+		if kubeConfig.CurrentContext == name {
+			kubeConfig.CurrentContext = ""
+		}
+		pruned = append(pruned, name)
+		removed = append(removed, kubeContext)
+	}
+	clustersInUse := map[string]bool{}
+	authInfosInUse := map[string]bool{}
+	for _, kubeContext := range kubeConfig.Contexts {
+		clustersInUse[kubeContext.Cluster] = true
+		authInfosInUse[kubeContext.AuthInfo] = true
+	}
+	for _, kubeContext := range removed {
+		if !clustersInUse[kubeContext.Cluster] {
+			delete(kubeConfig.Clusters, kubeContext.Cluster)
+		}
+		if !authInfosInUse[kubeContext.AuthInfo] {
+			delete(kubeConfig.AuthInfos, kubeContext.AuthInfo)
+		}
+	}
+	sort.Strings(pruned)
+	return pruned
+}
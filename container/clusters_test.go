@@ -0,0 +1,87 @@
+package container
+
+import (
+	"testing"
+
+	"github.com/gartnera/gcloud/config"
+	"github.com/stretchr/testify/require"
+	clientcmd "k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func loadKubeConfigFixture(t *testing.T) *clientcmdapi.Config {
+	kubeConfig, err := clientcmd.LoadFromFile("testdata/repair-kubeconfig.yaml")
+	require.NoError(t, err)
+	return kubeConfig
+}
+
+func TestIsGkeAuthInfo(t *testing.T) {
+	kubeConfig := loadKubeConfigFixture(t)
+	tests := map[string]bool{
+		"gke_my-project_us-central1_legacy": true,
+		"gke_my-project_us-central1_plugin": true,
+		"gke_my-project_us-central1_self":   true,
+		"prod":                              true,
+		"gke_my-project_us-central1_manual": false,
+		"aws":                               false,
+		"kind-kind":                         false,
+	}
+	require.Len(t, kubeConfig.AuthInfos, len(tests))
+	for name, want := range tests {
+		require.Equal(t, want, isGkeAuthInfo(kubeConfig.AuthInfos[name]), name)
+	}
+}
+
+func TestRepairKubeConfig(t *testing.T) {
+	kubeConfig := loadKubeConfigFixture(t)
+	repaired, err := repairKubeConfig(kubeConfig, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"gke_my-project_us-central1_legacy",
+		"gke_my-project_us-central1_plugin",
+		"gke_my-project_us-central1_self",
+		"prod",
+	}, repaired)
+
+	for _, name := range repaired {
+		authInfo := kubeConfig.AuthInfos[name]
+		require.Nil(t, authInfo.AuthProvider, name)
+		require.NotNil(t, authInfo.Exec, name)
+		require.Equal(t, config.GkeAuthPluginName, authInfo.Exec.Command, name)
+		require.Equal(t, "client.authentication.k8s.io/v1beta1", authInfo.Exec.APIVersion, name)
+		require.True(t, authInfo.Exec.ProvideClusterInfo, name)
+	}
+	// the identity of the context is kept
+	self := kubeConfig.AuthInfos["gke_my-project_us-central1_self"].Exec
+	// gke-gcloud-auth-plugin does not accept --impersonate-service-account
+	require.Empty(t, self.Args)
+	require.Equal(t, []clientcmdapi.ExecEnvVar{
+		{Name: "CLOUDSDK_CONFIG", Value: "/home/user/.config/gcloud-prod"},
+		{Name: "CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT", Value: "deployer@my-project.iam.gserviceaccount.com"},
+	}, self.Env)
+	require.Equal(t, "apps", kubeConfig.Contexts["gke_my-project_us-central1_plugin"].Namespace)
+
+	// everything else is left alone
+	require.Equal(t, "secret", kubeConfig.AuthInfos["gke_my-project_us-central1_manual"].Token)
+	require.Equal(t, "aws", kubeConfig.AuthInfos["aws"].Exec.Command)
+	require.Nil(t, kubeConfig.AuthInfos["kind-kind"].Exec)
+}
+
+func TestRepairKubeConfigExecSelf(t *testing.T) {
+	kubeConfig := loadKubeConfigFixture(t)
+	_, err := repairKubeConfig(kubeConfig, true)
+	require.NoError(t, err)
+	legacy := kubeConfig.AuthInfos["gke_my-project_us-central1_legacy"].Exec
+	require.Equal(t, []string{"config", "config-helper", "--format=client.authentication.k8s.io/v1"}, legacy.Args)
+	require.Equal(t, "client.authentication.k8s.io/v1", legacy.APIVersion)
+	self := kubeConfig.AuthInfos["gke_my-project_us-central1_self"].Exec
+	require.Equal(t, []string{"config", "config-helper", "--format=client.authentication.k8s.io/v1", "--impersonate-service-account=deployer@my-project.iam.gserviceaccount.com"}, self.Args)
+	require.Equal(t, []clientcmdapi.ExecEnvVar{{Name: "CLOUDSDK_CONFIG", Value: "/home/user/.config/gcloud-prod"}}, self.Env)
+
+	// and back to the plugin, which only takes the service account from the env
+	_, err = repairKubeConfig(kubeConfig, false)
+	require.NoError(t, err)
+	self = kubeConfig.AuthInfos["gke_my-project_us-central1_self"].Exec
+	require.Empty(t, self.Args)
+	require.Equal(t, "deployer@my-project.iam.gserviceaccount.com", execImpersonation(kubeConfig.AuthInfos["gke_my-project_us-central1_self"]))
+}
@@ -0,0 +1,158 @@
+package container
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/gartnera/gcloud/auth"
+	"golang.org/x/oauth2"
+	htransport "google.golang.org/api/transport/http"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	endpointPublic   = "public"
+	endpointInternal = "internal"
+	endpointDNS      = "dns"
+	endpointAuto     = "auto"
+)
+
+// containerEndpoint is the REST endpoint of the container api
+var containerEndpoint = "https://container.googleapis.com/"
+
+// dnsEndpointResponse is the subset of the REST cluster resource we need. The
+// generated client we use predates the dns based control plane endpoint.
+type dnsEndpointResponse struct {
+	ControlPlaneEndpointsConfig struct {
+		DNSEndpointConfig struct {
+			Endpoint string `json:"endpoint"`
+		} `json:"dnsEndpointConfig"`
+	} `json:"controlPlaneEndpointsConfig"`
+}
+
+// getDNSEndpoint returns the dns based control plane endpoint or an empty string
+// if it is not enabled
+func getDNSEndpoint(ctx context.Context, ts oauth2.TokenSource, gName string) (string, error) {
+	opts, err := auth.ClientOptions(ts, containerEndpoint)
+	if err != nil {
+		return "", err
+	}
+	client, endpoint, err := htransport.NewClient(ctx, opts...)
+	if err != nil {
+		return "", fmt.Errorf("unable to get container client: %w", err)
+	}
+	url := fmt.Sprintf("%sv1/%s?fields=controlPlaneEndpointsConfig.dnsEndpointConfig", endpoint, gName)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to create request: %w", err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to get cluster dns endpoint: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to get cluster dns endpoint: %s", res.Status)
+	}
+	endpointRes := &dnsEndpointResponse{}
+	err = json.NewDecoder(res.Body).Decode(endpointRes)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode cluster dns endpoint: %w", err)
+	}
+	return endpointRes.ControlPlaneEndpointsConfig.DNSEndpointConfig.Endpoint, nil
+}
+
+// onClusterNetwork detects if we are running on a GCE instance in the same
+// network as the cluster and can therefore reach the private endpoint
+func onClusterNetwork(cluster *containerpb.Cluster) bool {
+	if !metadata.OnGCE() {
+		return false
+	}
+	network, err := metadata.Get("instance/network-interfaces/0/network")
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(network, "/networks/"+cluster.GetNetwork())
+}
+
+// autoEndpointMode picks the endpoint that is most likely reachable from here
+func autoEndpointMode(cluster *containerpb.Cluster, dnsEndpoint string) string {
+	privateConfig := cluster.GetPrivateClusterConfig()
+	hasPrivateEndpoint := privateConfig.GetPrivateEndpoint() != ""
+	if hasPrivateEndpoint && onClusterNetwork(cluster) {
+		return endpointInternal
+	}
+	publicRestricted := privateConfig.GetEnablePrivateEndpoint() || cluster.GetMasterAuthorizedNetworksConfig().GetEnabled()
+	if !publicRestricted {
+		return endpointPublic
+	}
+	// the dns endpoint is authorized with IAM rather than by network
+	if dnsEndpoint != "" {
+		return endpointDNS
+	}
+	if privateConfig.GetEnablePrivateEndpoint() {
+		return endpointInternal
+	}
+	return endpointPublic
+}
+
+// clusterServer returns the kubeconfig server and certificate authority for the endpoint mode
+func clusterServer(ctx context.Context, warnings io.Writer, ts oauth2.TokenSource, cluster *containerpb.Cluster, gName string, mode string) (string, []byte, error) {
+	dnsEndpoint := ""
+	if mode == endpointDNS || mode == endpointAuto {
+		var err error
+		dnsEndpoint, err = getDNSEndpoint(ctx, ts, gName)
+		if err != nil && mode == endpointDNS {
+			return "", nil, err
+		}
+		// auto can still pick one of the ip endpoints
+		if err != nil {
+			fmt.Fprintf(warnings, "WARNING: %s: %v, not considering the dns endpoint\n", gName, err)
+			dnsEndpoint = ""
+		}
+	}
+	if mode == endpointAuto {
+		mode = autoEndpointMode(cluster, dnsEndpoint)
+	}
+
+	if mode == endpointDNS {
+		if dnsEndpoint == "" {
+			return "", nil, errors.New("cluster does not have a dns endpoint")
+		}
+		// the dns endpoint uses a publicly trusted certificate
+		return fmt.Sprintf("https://%s", dnsEndpoint), nil, nil
+	}
+
+	endpoint := cluster.Endpoint
+	if mode == endpointInternal {
+		endpoint = cluster.GetPrivateClusterConfig().GetPrivateEndpoint()
+		if endpoint == "" {
+			return "", nil, errors.New("cluster does not have an internal endpoint")
+		}
+	}
+	caCertificateDecoded, err := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClusterCaCertificate)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to decode ca certificate: %w", err)
+	}
+	return fmt.Sprintf("https://%s", endpoint), caCertificateDecoded, nil
+}
+
+// newKubeConfigCluster returns the kubeconfig cluster entry for the endpoint mode
+func newKubeConfigCluster(ctx context.Context, warnings io.Writer, ts oauth2.TokenSource, cluster *containerpb.Cluster, gName string, mode string) (*clientcmdapi.Cluster, error) {
+	server, caData, err := clusterServer(ctx, warnings, ts, cluster, gName, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &clientcmdapi.Cluster{
+		Server:                   server,
+		CertificateAuthorityData: caData,
+	}, nil
+}
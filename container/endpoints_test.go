@@ -0,0 +1,78 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+)
+
+// serveContainerAPI points the container REST api at handler
+func serveContainerAPI(t *testing.T, handler http.HandlerFunc) {
+	t.Setenv("CLOUDSDK_CONFIG", t.TempDir())
+	t.Setenv("GOOGLE_API_USE_CLIENT_CERTIFICATE", "false")
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	endpoint := containerEndpoint
+	containerEndpoint = server.URL + "/"
+	t.Cleanup(func() {
+		containerEndpoint = endpoint
+	})
+}
+
+func TestClusterServerDNSLookupFailed(t *testing.T) {
+	serveContainerAPI(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "permission denied", http.StatusForbidden)
+	})
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})
+	cluster := &containerpb.Cluster{
+		Endpoint:   "34.1.2.3",
+		MasterAuth: &containerpb.MasterAuth{ClusterCaCertificate: base64.StdEncoding.EncodeToString([]byte("ca"))},
+	}
+	gName := "projects/p/locations/us-central1/clusters/prod"
+
+	// auto falls back to the ip endpoints
+	warnings := new(bytes.Buffer)
+	server, caData, err := clusterServer(context.Background(), warnings, ts, cluster, gName, endpointAuto)
+	require.NoError(t, err)
+	require.Equal(t, "https://34.1.2.3", server)
+	require.Equal(t, []byte("ca"), caData)
+	require.Contains(t, warnings.String(), "WARNING: "+gName)
+	require.Contains(t, warnings.String(), "403")
+
+	// an explicit --dns-endpoint fails
+	_, _, err = clusterServer(context.Background(), new(bytes.Buffer), ts, cluster, gName, endpointDNS)
+	require.ErrorContains(t, err, "403")
+}
+
+func TestClusterServerDNS(t *testing.T) {
+	serveContainerAPI(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/projects/p/locations/us-central1/clusters/prod" || req.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"controlPlaneEndpointsConfig": {"dnsEndpointConfig": {"endpoint": "gke-123.us-central1.gke.goog"}}}`)
+	})
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})
+	cluster := &containerpb.Cluster{
+		Endpoint: "34.1.2.3",
+		PrivateClusterConfig: &containerpb.PrivateClusterConfig{
+			EnablePrivateEndpoint: true,
+		},
+	}
+	for _, mode := range []string{endpointDNS, endpointAuto} {
+		warnings := new(bytes.Buffer)
+		server, caData, err := clusterServer(context.Background(), warnings, ts, cluster, "projects/p/locations/us-central1/clusters/prod", mode)
+		require.NoError(t, err, mode)
+		require.Equal(t, "https://gke-123.us-central1.gke.goog", server, mode)
+		require.Nil(t, caData, mode)
+		require.Empty(t, warnings.String(), mode)
+	}
+}
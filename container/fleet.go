@@ -0,0 +1,221 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gartnera/gcloud/auth"
+	"github.com/gartnera/gcloud/helpers"
+	"github.com/spf13/cobra"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	gkehub "google.golang.org/api/gkehub/v1"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// defaultFleetContextNameTemplate matches the context names written by python gcloud
+const defaultFleetContextNameTemplate = "connectgateway_{project}_{location}_{cluster}"
+
+var fleetCmd = &cobra.Command{
+	Use: "fleet",
+}
+
+var membershipsCmd = &cobra.Command{
+	Use: "memberships",
+}
+
+var membershipColumns = []helpers.Column{
+	{Path: "name"},
+	{Path: "uniqueId", Label: "UNIQUE_ID"},
+	{Path: "location"},
+	{Path: "state.code", Label: "STATE"},
+}
+
+// newHubService returns a gkehub client using our token source
+func newHubService(cmd *cobra.Command) (*gkehub.Service, error) {
+	ts, err := auth.TokenSource()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get token source: %w", err)
+	}
+	opts, err := auth.ClientOptions(ts, "https://gkehub.googleapis.com/")
+	if err != nil {
+		return nil, err
+	}
+	svc, err := gkehub.NewService(cmd.Context(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get gkehub client: %w", err)
+	}
+	return svc, nil
+}
+
+// membershipLocation returns the location of the membership from its resource name
+// (projects/PROJECT/locations/LOCATION/memberships/MEMBERSHIP)
+func membershipLocation(name string) string {
+	parts := strings.Split(name, "/")
+	if len(parts) != 6 {
+		return ""
+	}
+	return parts[3]
+}
+
+// membershipLocationFlag returns the location from --location, --region, or
+// --zone. Memberships are global or regional, so the compute location
+// properties do not apply.
+func membershipLocationFlag(cFlags *commonArgs) string {
+	if cFlags.locationFromProperty {
+		return ""
+	}
+	return cFlags.location
+}
+
+// findMembership returns the membership called name. If location is empty,
+// it is discovered by searching for the membership in all locations.
+func findMembership(ctx context.Context, svc *gkehub.Service, project string, location string, name string) (*gkehub.Membership, error) {
+	if location != "" {
+		gName := fmt.Sprintf("projects/%s/locations/%s/memberships/%s", project, location, name)
+		membership, err := svc.Projects.Locations.Memberships.Get(gName).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get membership %s: %w", name, err)
+		}
+		return membership, nil
+	}
+	var candidates []*gkehub.Membership
+	parent := fmt.Sprintf("projects/%s/locations/-", project)
+	err := svc.Projects.Locations.Memberships.List(parent).Pages(ctx, func(res *gkehub.ListMembershipsResponse) error {
+		for _, membership := range res.Resources {
+			if strings.HasSuffix(membership.Name, "/memberships/"+name) {
+				candidates = append(candidates, membership)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list memberships: %w", err)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("membership %s not found in project %s, use --location to specify the location", name, project)
+	}
+	if len(candidates) > 1 {
+		var locations []string
+		for _, membership := range candidates {
+			locations = append(locations, membershipLocation(membership.Name))
+		}
+		return nil, fmt.Errorf("membership %s exists in multiple locations (%s), use --location to pick one", name, strings.Join(locations, ", "))
+	}
+	return candidates[0], nil
+}
+
+// connectGatewayServer returns the Connect Gateway url of the membership. This
+// ends up in the kubeconfig, and kubectl does not present a client
+// certificate, so it is always the public host even when gcloud uses mTLS.
+func connectGatewayServer(projectNumber int64, membership *gkehub.Membership) string {
+	location := membershipLocation(membership.Name)
+	host := "connectgateway.googleapis.com"
+	if location != "global" {
+		host = location + "-" + host
+	}
+	collection := "memberships"
+	if membership.Endpoint != nil && membership.Endpoint.GkeCluster != nil {
+		collection = "gkeMemberships"
+	}
+	membershipID := membership.Name[strings.LastIndex(membership.Name, "/")+1:]
+	return fmt.Sprintf("https://%s/v1/projects/%d/locations/%s/%s/%s", host, projectNumber, location, collection, membershipID)
+}
+
+var membershipsListCmd = &cobra.Command{
+	Use:          "list",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cFlags, err := getCommonFlags(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		svc, err := newHubService(cmd)
+		if err != nil {
+			return err
+		}
+		location := membershipLocationFlag(cFlags)
+		if location == "" {
+			location = "-"
+		}
+		parent := fmt.Sprintf("projects/%s/locations/%s", cFlags.project, location)
+		var resources []helpers.Resource
+		err = svc.Projects.Locations.Memberships.List(parent).Pages(cmd.Context(), func(res *gkehub.ListMembershipsResponse) error {
+			for _, membership := range res.Resources {
+				resource, err := helpers.ToResource(membership)
+				if err != nil {
+					return err
+				}
+				resource["location"] = membershipLocation(membership.Name)
+				resource["name"] = membership.Name[strings.LastIndex(membership.Name, "/")+1:]
+				resources = append(resources, resource)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("unable to list memberships: %w", err)
+		}
+		return helpers.PrintResources(cmd, resources, membershipColumns)
+	},
+}
+
+var membershipsGetCredentialsCmd = &cobra.Command{
+	Use:          "get-credentials NAME",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		cFlags, err := getCommonFlags(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		svc, err := newHubService(cmd)
+		if err != nil {
+			return err
+		}
+		membership, err := findMembership(ctx, svc, cFlags.project, membershipLocationFlag(cFlags), args[0])
+		if err != nil {
+			return err
+		}
+		location := membershipLocation(membership.Name)
+
+		// the gateway only accepts project numbers
+		ts, err := auth.TokenSource()
+		if err != nil {
+			return fmt.Errorf("unable to get token source: %w", err)
+		}
+		opts, err := auth.ClientOptions(ts, "https://cloudresourcemanager.googleapis.com/")
+		if err != nil {
+			return err
+		}
+		crm, err := cloudresourcemanager.NewService(ctx, opts...)
+		if err != nil {
+			return fmt.Errorf("unable to get resource manager client: %w", err)
+		}
+		project, err := crm.Projects.Get(cFlags.project).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("unable to get project %s: %w", cFlags.project, err)
+		}
+
+		// the gateway uses a publicly trusted certificate
+		kubeCluster := &clientcmdapi.Cluster{
+			Server: connectGatewayServer(project.ProjectNumber, membership),
+		}
+		contextNameTemplate, _ := cmd.Flags().GetString("context-name")
+		kName := renderContextName(contextNameTemplate, cFlags.project, location, args[0])
+		// the membership is not necessarily a GKE cluster, so it is never pruned
+		return writeCredentials(cmd, kName, "", kubeCluster)
+	},
+}
+
+func registerFleetCmd(parent *cobra.Command) {
+	helpers.AddFormatFlags(membershipsListCmd.Flags(), true)
+	membershipsCmd.AddCommand(membershipsListCmd)
+	fs := membershipsGetCredentialsCmd.Flags()
+	addKubeConfigFlags(fs)
+	fs.String("context-name", defaultFleetContextNameTemplate, "context name template, {project}, {location}, and {cluster} (the membership) are replaced")
+	membershipsCmd.AddCommand(membershipsGetCredentialsCmd)
+	fleetCmd.AddCommand(membershipsCmd)
+	parent.AddCommand(fleetCmd)
+}
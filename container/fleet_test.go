@@ -0,0 +1,101 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	gkehub "google.golang.org/api/gkehub/v1"
+	"google.golang.org/api/option"
+)
+
+func TestConnectGatewayServer(t *testing.T) {
+	t.Setenv("GOOGLE_API_USE_CLIENT_CERTIFICATE", "false")
+	attached := &gkehub.Membership{Name: "projects/my-project/locations/global/memberships/eks-prod"}
+	require.Equal(t, "https://connectgateway.googleapis.com/v1/projects/1234/locations/global/memberships/eks-prod", connectGatewayServer(1234, attached))
+
+	gke := &gkehub.Membership{
+		Name:     "projects/my-project/locations/us-central1/memberships/prod",
+		Endpoint: &gkehub.MembershipEndpoint{GkeCluster: &gkehub.GkeCluster{}},
+	}
+	require.Equal(t, "https://us-central1-connectgateway.googleapis.com/v1/projects/1234/locations/us-central1/gkeMemberships/prod", connectGatewayServer(1234, gke))
+}
+
+func TestConnectGatewayServerMTLS(t *testing.T) {
+	t.Setenv("GOOGLE_API_USE_CLIENT_CERTIFICATE", "true")
+	gke := &gkehub.Membership{
+		Name:     "projects/my-project/locations/us-central1/memberships/prod",
+		Endpoint: &gkehub.MembershipEndpoint{GkeCluster: &gkehub.GkeCluster{}},
+	}
+	require.Equal(t, "https://us-central1-connectgateway.googleapis.com/v1/projects/1234/locations/us-central1/gkeMemberships/prod", connectGatewayServer(1234, gke))
+}
+
+// newFakeHubService serves memberships from a fixed list
+func newFakeHubService(t *testing.T, memberships []*gkehub.Membership) (*gkehub.Service, *[]string) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.URL.Path)
+		name := strings.TrimPrefix(req.URL.Path, "/v1/")
+		if strings.HasSuffix(name, "/memberships") {
+			_ = json.NewEncoder(w).Encode(&gkehub.ListMembershipsResponse{Resources: memberships})
+			return
+		}
+		for _, membership := range memberships {
+			if membership.Name == name {
+				_ = json.NewEncoder(w).Encode(membership)
+				return
+			}
+		}
+		http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+	svc, err := gkehub.NewService(context.Background(), option.WithEndpoint(server.URL+"/"), option.WithHTTPClient(server.Client()))
+	require.NoError(t, err)
+	return svc, &requests
+}
+
+func TestFindMembership(t *testing.T) {
+	svc, requests := newFakeHubService(t, []*gkehub.Membership{
+		{Name: "projects/p/locations/global/memberships/eks-prod"},
+		{Name: "projects/p/locations/us-central1/memberships/prod"},
+		{Name: "projects/p/locations/us-central1/memberships/dup"},
+		{Name: "projects/p/locations/europe-west1/memberships/dup"},
+	})
+	ctx := context.Background()
+	tests := []struct {
+		location string
+		name     string
+		want     string
+		requests []string
+		wantErr  bool
+	}{
+		{"", "prod", "projects/p/locations/us-central1/memberships/prod", []string{"/v1/projects/p/locations/-/memberships"}, false},
+		{"", "eks-prod", "projects/p/locations/global/memberships/eks-prod", []string{"/v1/projects/p/locations/-/memberships"}, false},
+		{"us-central1", "prod", "projects/p/locations/us-central1/memberships/prod", []string{"/v1/projects/p/locations/us-central1/memberships/prod"}, false},
+		{"europe-west1", "dup", "projects/p/locations/europe-west1/memberships/dup", []string{"/v1/projects/p/locations/europe-west1/memberships/dup"}, false},
+		{"", "dup", "", nil, true},
+		{"", "missing", "", nil, true},
+		{"global", "prod", "", nil, true},
+	}
+	for _, tt := range tests {
+		*requests = nil
+		membership, err := findMembership(ctx, svc, "p", tt.location, tt.name)
+		if tt.wantErr {
+			require.Error(t, err, "%s %s", tt.location, tt.name)
+			continue
+		}
+		require.NoError(t, err, "%s %s", tt.location, tt.name)
+		require.Equal(t, tt.want, membership.Name)
+		require.Equal(t, tt.requests, *requests)
+	}
+}
+
+func TestMembershipLocationFlag(t *testing.T) {
+	require.Equal(t, "us-central1", membershipLocationFlag(&commonArgs{location: "us-central1"}))
+	// memberships are not zonal, so the compute properties don't apply
+	require.Equal(t, "", membershipLocationFlag(&commonArgs{location: "us-central1-a", locationFromProperty: true}))
+}
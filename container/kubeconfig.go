@@ -0,0 +1,236 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gartnera/gcloud/config"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientcmd "k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const impersonateArgPrefix = "--impersonate-service-account="
+
+// impersonateEnv is honored by gcloud, which the real gke-gcloud-auth-plugin
+// runs. The plugin itself does not accept --impersonate-service-account.
+const impersonateEnv = "CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT"
+
+// newExecConfig returns the kubeconfig exec config used to authenticate to GKE.
+// If execSelf is set, the currently running binary is used rather than
+// gke-gcloud-auth-plugin from the PATH.
+func newExecConfig(execSelf bool, impersonate string) (*clientcmdapi.ExecConfig, error) {
+	execConfig := &clientcmdapi.ExecConfig{
+		Command:            config.GkeAuthPluginName,
+		APIVersion:         "client.authentication.k8s.io/v1beta1",
+		InteractiveMode:    clientcmdapi.NeverExecInteractiveMode,
+		ProvideClusterInfo: true,
+	}
+	if execSelf {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("unable to find current executable: %w", err)
+		}
+		execConfig.Command = self
+		execConfig.Args = []string{"config", "config-helper", "--format=client.authentication.k8s.io/v1"}
+		execConfig.APIVersion = "client.authentication.k8s.io/v1"
+	}
+	// pin the identity of the context so that it does not depend on the environment kubectl runs in
+	if impersonate != "" {
+		if execSelf {
+			execConfig.Args = append(execConfig.Args, impersonateArgPrefix+impersonate)
+		} else {
+			execConfig.Env = append(execConfig.Env, clientcmdapi.ExecEnvVar{Name: impersonateEnv, Value: impersonate})
+		}
+	}
+	return execConfig, nil
+}
+
+// isGkeAuthInfo detects auth infos which were written by get-credentials (either
+// python gcloud or this one) including the legacy gcp auth provider
+func isGkeAuthInfo(authInfo *clientcmdapi.AuthInfo) bool {
+	if authInfo.AuthProvider != nil {
+		return authInfo.AuthProvider.Name == "gcp"
+	}
+	if authInfo.Exec == nil {
+		return false
+	}
+	if filepath.Base(authInfo.Exec.Command) == config.GkeAuthPluginName {
+		return true
+	}
+	for _, arg := range authInfo.Exec.Args {
+		if arg == "config-helper" {
+			return true
+		}
+	}
+	return false
+}
+
+// execImpersonation extracts the impersonated service account from the exec args or env
+func execImpersonation(authInfo *clientcmdapi.AuthInfo) string {
+	if authInfo.Exec == nil {
+		return ""
+	}
+	for _, arg := range authInfo.Exec.Args {
+		if strings.HasPrefix(arg, impersonateArgPrefix) {
+			return strings.TrimPrefix(arg, impersonateArgPrefix)
+		}
+	}
+	for _, env := range authInfo.Exec.Env {
+		if env.Name == impersonateEnv {
+			return env.Value
+		}
+	}
+	return ""
+}
+
+// gkeClusterExtension is the context extension holding the full resource name of
+// the cluster the context was written for. Context names depend on
+// --context-name, so this is how get-credentials --all --prune finds them.
+const gkeClusterExtension = "gcloud.gartnera.github.com/cluster"
+
+type gkeClusterInfo struct {
+	Name string `json:"name"`
+}
+
+func setContextGkeCluster(kubeContext *clientcmdapi.Context, gName string) {
+	// encoding a struct of strings can't fail
+	raw, _ := json.Marshal(&gkeClusterInfo{Name: gName})
+	if kubeContext.Extensions == nil {
+		kubeContext.Extensions = map[string]runtime.Object{}
+	}
+	kubeContext.Extensions[gkeClusterExtension] = &runtime.Unknown{Raw: raw, ContentType: runtime.ContentTypeJSON}
+}
+
+// contextGkeCluster returns the full resource name of the cluster the context
+// was written for, or an empty string if it was not written by this gcloud
+func contextGkeCluster(kubeContext *clientcmdapi.Context) string {
+	extension, ok := kubeContext.Extensions[gkeClusterExtension].(*runtime.Unknown)
+	if !ok {
+		return ""
+	}
+	info := &gkeClusterInfo{}
+	if json.Unmarshal(extension.Raw, info) != nil {
+		return ""
+	}
+	return info.Name
+}
+
+// defaultContextNameTemplate matches the context names written by python gcloud
+const defaultContextNameTemplate = "gke_{project}_{location}_{cluster}"
+
+// kubeConfigLockTimeout is how long we wait for other processes to finish modifying the kubeconfig
+var kubeConfigLockTimeout = 30 * time.Second
+
+func renderContextName(template string, project string, location string, cluster string) string {
+	r := strings.NewReplacer(
+		"{project}", project,
+		"{location}", location,
+		"{cluster}", cluster,
+	)
+	return r.Replace(template)
+}
+
+// lockKubeConfigFile takes a lock on the kubeconfig the same way kubectl does (filename.lock),
+// but waits for the lock to be released rather than failing immediately
+func lockKubeConfigFile(filename string) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create kubeconfig directory: %w", err)
+	}
+	lockPath := filename + ".lock"
+	deadline := time.Now().Add(kubeConfigLockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL, 0)
+		if err == nil {
+			return f.Close()
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("unable to lock kubeconfig: %w", err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for kubeconfig lock %s, remove it if no other process is modifying the kubeconfig", lockPath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func unlockKubeConfigFile(filename string) {
+	_ = os.Remove(filename + ".lock")
+}
+
+// modifyKubeConfig performs a locked read-modify-write of the merged kubeconfig
+// using the client-go loading rules (KUBECONFIG may contain multiple paths).
+// Modified entries are written back to the file they came from. New entries
+// should be added with setKubeConfigEntry.
+func modifyKubeConfig(explicitPath string, modify func(kubeConfig *clientcmdapi.Config, files []string) error) error {
+	pathOptions := clientcmd.NewDefaultPathOptions()
+	pathOptions.LoadingRules.ExplicitPath = explicitPath
+	files := pathOptions.GetLoadingPrecedence()
+
+	// sort the files so we always lock in the same order to avoid deadlock
+	lockFiles := append([]string{}, files...)
+	sort.Strings(lockFiles)
+	for _, filename := range lockFiles {
+		err := lockKubeConfigFile(filename)
+		if err != nil {
+			return err
+		}
+		defer unlockKubeConfigFile(filename)
+	}
+
+	kubeConfig, err := pathOptions.GetStartingConfig()
+	if err != nil {
+		return fmt.Errorf("unable to load kubeconfig: %w", err)
+	}
+	err = modify(kubeConfig, files)
+	if err != nil {
+		return err
+	}
+
+	// we are already holding the locks. The flag is global, so put it back for
+	// anything else in the process that modifies a kubeconfig.
+	useModifyConfigLock := clientcmd.UseModifyConfigLock
+	clientcmd.UseModifyConfigLock = false
+	defer func() {
+		clientcmd.UseModifyConfigLock = useModifyConfigLock
+	}()
+	err = clientcmd.ModifyConfig(pathOptions, *kubeConfig, false)
+	if err != nil {
+		return fmt.Errorf("unable to write kubeconfig: %w", err)
+	}
+	return nil
+}
+
+// setKubeConfigEntry sets the cluster, user, and context called name. If a context
+// with this name already exists, the entries are written to the file that holds
+// it, otherwise to the first kubeconfig file. gName is the full resource name of
+// the GKE cluster, if any, which is recorded in the context.
+func setKubeConfigEntry(kubeConfig *clientcmdapi.Config, files []string, name string, gName string, cluster *clientcmdapi.Cluster, authInfo *clientcmdapi.AuthInfo) {
+	destination := files[0]
+	namespace := ""
+	if existing, ok := kubeConfig.Contexts[name]; ok {
+		if existing.LocationOfOrigin != "" {
+			destination = existing.LocationOfOrigin
+		}
+		namespace = existing.Namespace
+	}
+	cluster.LocationOfOrigin = destination
+	authInfo.LocationOfOrigin = destination
+	kubeConfig.Clusters[name] = cluster
+	kubeConfig.AuthInfos[name] = authInfo
+	kubeConfig.Contexts[name] = &clientcmdapi.Context{
+		LocationOfOrigin: destination,
+		Cluster:          name,
+		AuthInfo:         name,
+		Namespace:        namespace,
+	}
+	if gName != "" {
+		setContextGkeCluster(kubeConfig.Contexts[name], gName)
+	}
+}
@@ -0,0 +1,184 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gartnera/gcloud/config"
+	"github.com/stretchr/testify/require"
+	clientcmd "k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// gkeAuthInfo is an auth info like the ones get-credentials writes
+func gkeAuthInfo() *clientcmdapi.AuthInfo {
+	return &clientcmdapi.AuthInfo{
+		Exec: &clientcmdapi.ExecConfig{
+			Command:    config.GkeAuthPluginName,
+			APIVersion: "client.authentication.k8s.io/v1beta1",
+		},
+	}
+}
+
+// addKubeConfigEntry adds a cluster, user, and context called name to kubeConfig
+func addKubeConfigEntry(kubeConfig *clientcmdapi.Config, name string, authInfo *clientcmdapi.AuthInfo) {
+	kubeConfig.Clusters[name] = &clientcmdapi.Cluster{Server: "https://" + name}
+	kubeConfig.AuthInfos[name] = authInfo
+	kubeConfig.Contexts[name] = &clientcmdapi.Context{Cluster: name, AuthInfo: name}
+}
+
+// writeKubeConfigFiles writes a kubeconfig file for each config and points
+// KUBECONFIG at them
+func writeKubeConfigFiles(t *testing.T, kubeConfigs ...*clientcmdapi.Config) []string {
+	dir := t.TempDir()
+	var files []string
+	for i, kubeConfig := range kubeConfigs {
+		filename := filepath.Join(dir, string(rune('a'+i)))
+		require.NoError(t, clientcmd.WriteToFile(*kubeConfig, filename))
+		files = append(files, filename)
+	}
+	t.Setenv("KUBECONFIG", strings.Join(files, string(os.PathListSeparator)))
+	return files
+}
+
+func TestRenderContextName(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{defaultContextNameTemplate, "gke_my-project_us-central1_prod"},
+		{"{cluster}", "prod"},
+		{"{project}/{cluster}-{cluster}", "my-project/prod-prod"},
+		{"static", "static"},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, renderContextName(tt.template, "my-project", "us-central1", "prod"), tt.template)
+	}
+}
+
+func TestModifyKubeConfigMultipleFiles(t *testing.T) {
+	first := clientcmdapi.NewConfig()
+	addKubeConfigEntry(first, "kind", &clientcmdapi.AuthInfo{Token: "secret"})
+	first.CurrentContext = "kind"
+	second := clientcmdapi.NewConfig()
+	addKubeConfigEntry(second, "gke_my-project_us-central1_prod", gkeAuthInfo())
+	second.Contexts["gke_my-project_us-central1_prod"].Namespace = "apps"
+	files := writeKubeConfigFiles(t, first, second)
+
+	err := modifyKubeConfig("", func(kubeConfig *clientcmdapi.Config, files []string) error {
+		// the existing context is updated in the file it came from
+		setKubeConfigEntry(kubeConfig, files, "gke_my-project_us-central1_prod", "projects/my-project/locations/us-central1/clusters/prod", &clientcmdapi.Cluster{Server: "https://10.0.0.1"}, gkeAuthInfo())
+		// new contexts go to the first file
+		setKubeConfigEntry(kubeConfig, files, "gke_my-project_us-west1_dev", "projects/my-project/locations/us-west1/clusters/dev", &clientcmdapi.Cluster{Server: "https://10.0.0.2"}, gkeAuthInfo())
+		kubeConfig.CurrentContext = "gke_my-project_us-west1_dev"
+		return nil
+	})
+	require.NoError(t, err)
+
+	first, err = clientcmd.LoadFromFile(files[0])
+	require.NoError(t, err)
+	require.Contains(t, first.Contexts, "kind")
+	require.Equal(t, "secret", first.AuthInfos["kind"].Token)
+	require.Contains(t, first.Contexts, "gke_my-project_us-west1_dev")
+	require.Equal(t, "https://10.0.0.2", first.Clusters["gke_my-project_us-west1_dev"].Server)
+	require.NotContains(t, first.Contexts, "gke_my-project_us-central1_prod")
+	require.Equal(t, "gke_my-project_us-west1_dev", first.CurrentContext)
+
+	second, err = clientcmd.LoadFromFile(files[1])
+	require.NoError(t, err)
+	require.Equal(t, "https://10.0.0.1", second.Clusters["gke_my-project_us-central1_prod"].Server)
+	require.Equal(t, "apps", second.Contexts["gke_my-project_us-central1_prod"].Namespace)
+	require.NotContains(t, second.Contexts, "gke_my-project_us-west1_dev")
+	// the cluster survives the round trip through the file
+	require.Equal(t, "projects/my-project/locations/us-central1/clusters/prod", contextGkeCluster(second.Contexts["gke_my-project_us-central1_prod"]))
+	require.Equal(t, "", contextGkeCluster(first.Contexts["kind"]))
+
+	for _, filename := range files {
+		require.NoFileExists(t, filename+".lock")
+	}
+	require.True(t, clientcmd.UseModifyConfigLock)
+}
+
+func TestModifyKubeConfigStaleLock(t *testing.T) {
+	timeout := kubeConfigLockTimeout
+	kubeConfigLockTimeout = 200 * time.Millisecond
+	t.Cleanup(func() {
+		kubeConfigLockTimeout = timeout
+	})
+	kubeConfig := clientcmdapi.NewConfig()
+	addKubeConfigEntry(kubeConfig, "kind", &clientcmdapi.AuthInfo{Token: "secret"})
+	files := writeKubeConfigFiles(t, kubeConfig)
+	before, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(files[0]+".lock", nil, 0600))
+
+	modified := false
+	err = modifyKubeConfig("", func(kubeConfig *clientcmdapi.Config, files []string) error {
+		modified = true
+		return nil
+	})
+	require.ErrorContains(t, err, files[0]+".lock")
+	require.False(t, modified)
+	after, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	// the lock belongs to someone else
+	require.FileExists(t, files[0]+".lock")
+}
+
+func TestPruneKubeConfig(t *testing.T) {
+	kubeConfig := clientcmdapi.NewConfig()
+	addKubeConfigEntry(kubeConfig, "gke_my-project_us-central1_prod", gkeAuthInfo())
+	addKubeConfigEntry(kubeConfig, "gke_my-project_us-central1_deleted", gkeAuthInfo())
+	addKubeConfigEntry(kubeConfig, "gke_my-project_us-west1_legacy", &clientcmdapi.AuthInfo{
+		AuthProvider: &clientcmdapi.AuthProviderConfig{Name: "gcp"},
+	})
+	// contexts written with --context-name are found by their cluster
+	addKubeConfigEntry(kubeConfig, "prod", gkeAuthInfo())
+	setContextGkeCluster(kubeConfig.Contexts["prod"], "projects/my-project/locations/us-central1/clusters/prod")
+	addKubeConfigEntry(kubeConfig, "old", gkeAuthInfo())
+	setContextGkeCluster(kubeConfig.Contexts["old"], "projects/my-project/locations/us-central1/clusters/old")
+	// the cluster still exists under this server
+	addKubeConfigEntry(kubeConfig, "gke_my-project_us-east1_moved", gkeAuthInfo())
+	kubeConfig.Clusters["gke_my-project_us-east1_moved"].Server = "https://10.0.0.9"
+	// contexts in projects which were not synced are kept
+	addKubeConfigEntry(kubeConfig, "gke_other-project_us-central1_deleted", gkeAuthInfo())
+	addKubeConfigEntry(kubeConfig, "other", gkeAuthInfo())
+	setContextGkeCluster(kubeConfig.Contexts["other"], "projects/other-project/locations/us-central1/clusters/deleted")
+	// contexts with other credentials were not written by get-credentials
+	addKubeConfigEntry(kubeConfig, "gke_my-project_us-central1_manual", &clientcmdapi.AuthInfo{Token: "secret"})
+	addKubeConfigEntry(kubeConfig, "kind", &clientcmdapi.AuthInfo{Token: "secret"})
+	// a context sharing the cluster of a pruned one keeps it
+	kubeConfig.Contexts["admin"] = &clientcmdapi.Context{Cluster: "gke_my-project_us-central1_deleted", AuthInfo: "kind"}
+	kubeConfig.CurrentContext = "gke_my-project_us-central1_deleted"
+
+	pruned := pruneKubeConfig(kubeConfig, map[string]bool{"my-project": true}, map[string]bool{
+		"projects/my-project/locations/us-central1/clusters/prod": true,
+		"https://10.0.0.9": true,
+	})
+	require.Equal(t, []string{"gke_my-project_us-central1_deleted", "gke_my-project_us-west1_legacy", "old"}, pruned)
+	require.Equal(t, "", kubeConfig.CurrentContext)
+
+	var contexts []string
+	for name := range kubeConfig.Contexts {
+		contexts = append(contexts, name)
+	}
+	require.ElementsMatch(t, []string{
+		"gke_my-project_us-central1_prod",
+		"prod",
+		"gke_my-project_us-east1_moved",
+		"gke_other-project_us-central1_deleted",
+		"other",
+		"gke_my-project_us-central1_manual",
+		"kind",
+		"admin",
+	}, contexts)
+	require.Contains(t, kubeConfig.Clusters, "gke_my-project_us-central1_deleted")
+	require.NotContains(t, kubeConfig.AuthInfos, "gke_my-project_us-central1_deleted")
+	require.NotContains(t, kubeConfig.Clusters, "gke_my-project_us-west1_legacy")
+	require.NotContains(t, kubeConfig.AuthInfos, "gke_my-project_us-west1_legacy")
+	require.NotContains(t, kubeConfig.Clusters, "old")
+}
@@ -0,0 +1,293 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	container "cloud.google.com/go/container/apiv1"
+	"github.com/gartnera/gcloud/helpers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+)
+
+var nodePoolsCmd = &cobra.Command{
+	Use: "node-pools",
+}
+
+var nodePoolColumns = []helpers.Column{
+	{Path: "name"},
+	{Path: "config.machineType", Label: "MACHINE_TYPE"},
+	{Path: "config.diskSizeGb", Label: "DISK_SIZE_GB"},
+	{Path: "version", Label: "NODE_VERSION"},
+}
+
+// nodePoolArgs are the resolved flags shared by the node-pools commands
+type nodePoolArgs struct {
+	*commonArgs
+	client *container.ClusterManagerClient
+	// clusterPath is the full resource name of the cluster the node pools belong to
+	clusterPath string
+}
+
+// getNodePoolArgs resolves the cluster from --cluster or the container/cluster property
+func getNodePoolArgs(ctx context.Context, fs *pflag.FlagSet) (*nodePoolArgs, error) {
+	cFlags, err := getCommonFlags(fs)
+	if err != nil {
+		return nil, err
+	}
+	clusterName, _ := fs.GetString("cluster")
+	if clusterName == "" {
+		clusterName = helpers.GetProperty("container", "cluster")
+	}
+	if clusterName == "" {
+		return nil, errors.New("--cluster is required (or set the container/cluster property)")
+	}
+	client, _, err := newClusterManagerClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gName, _, err := cFlags.clusterPath(ctx, client, clusterName)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &nodePoolArgs{
+		commonArgs:  cFlags,
+		client:      client,
+		clusterPath: gName,
+	}, nil
+}
+
+func (a *nodePoolArgs) nodePoolPath(name string) string {
+	return fmt.Sprintf("%s/nodePools/%s", a.clusterPath, name)
+}
+
+// getAutoscaling reads --enable-autoscaling, --min-nodes, and --max-nodes. It
+// returns nil if autoscaling was not mentioned.
+func getAutoscaling(fs *pflag.FlagSet) (*containerpb.NodePoolAutoscaling, error) {
+	if !fs.Changed("enable-autoscaling") {
+		if fs.Changed("min-nodes") || fs.Changed("max-nodes") {
+			return nil, errors.New("--min-nodes and --max-nodes require --enable-autoscaling")
+		}
+		return nil, nil
+	}
+	enabled, _ := fs.GetBool("enable-autoscaling")
+	if !enabled {
+		return &containerpb.NodePoolAutoscaling{}, nil
+	}
+	minNodes, _ := fs.GetInt32("min-nodes")
+	maxNodes, _ := fs.GetInt32("max-nodes")
+	if !fs.Changed("max-nodes") {
+		return nil, errors.New("--max-nodes is required with --enable-autoscaling")
+	}
+	if minNodes < 0 || maxNodes < minNodes || maxNodes < 1 {
+		return nil, errors.New("--max-nodes must be at least 1 and at least --min-nodes")
+	}
+	return &containerpb.NodePoolAutoscaling{
+		Enabled:      true,
+		MinNodeCount: minNodes,
+		MaxNodeCount: maxNodes,
+	}, nil
+}
+
+func addAutoscalingFlags(fs *pflag.FlagSet) {
+	fs.Bool("enable-autoscaling", false, "enable autoscaling of the node pool (use --no-enable-autoscaling to disable)")
+	fs.Bool("no-enable-autoscaling", false, "disable autoscaling of the node pool")
+	fs.Int32("min-nodes", 0, "minimum number of nodes per zone with autoscaling")
+	fs.Int32("max-nodes", 0, "maximum number of nodes per zone with autoscaling")
+}
+
+// normalizeAutoscalingFlags maps --no-enable-autoscaling onto --enable-autoscaling=false
+func normalizeAutoscalingFlags(fs *pflag.FlagSet) error {
+	if disabled, _ := fs.GetBool("no-enable-autoscaling"); disabled {
+		if fs.Changed("enable-autoscaling") {
+			return errors.New("only one of --enable-autoscaling or --no-enable-autoscaling may be set")
+		}
+		return fs.Set("enable-autoscaling", "false")
+	}
+	return nil
+}
+
+var nodePoolsListCmd = &cobra.Command{
+	Use:          "list",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		npArgs, err := getNodePoolArgs(ctx, cmd.Flags())
+		if err != nil {
+			return err
+		}
+		defer npArgs.client.Close()
+		res, err := npArgs.client.ListNodePools(ctx, &containerpb.ListNodePoolsRequest{Parent: npArgs.clusterPath})
+		if err != nil {
+			return fmt.Errorf("unable to list node pools: %w", err)
+		}
+		var resources []helpers.Resource
+		for _, nodePool := range res.NodePools {
+			resource, err := helpers.ToResource(nodePool)
+			if err != nil {
+				return err
+			}
+			resources = append(resources, resource)
+		}
+		return helpers.PrintResources(cmd, resources, nodePoolColumns)
+	},
+}
+
+var nodePoolsDescribeCmd = &cobra.Command{
+	Use:          "describe NAME",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		npArgs, err := getNodePoolArgs(ctx, cmd.Flags())
+		if err != nil {
+			return err
+		}
+		defer npArgs.client.Close()
+		nodePool, err := npArgs.client.GetNodePool(ctx, &containerpb.GetNodePoolRequest{Name: npArgs.nodePoolPath(args[0])})
+		if err != nil {
+			return fmt.Errorf("unable to get node pool %s: %w", args[0], err)
+		}
+		resource, err := helpers.ToResource(nodePool)
+		if err != nil {
+			return err
+		}
+		return helpers.PrintResource(cmd, resource)
+	},
+}
+
+var nodePoolsCreateCmd = &cobra.Command{
+	Use:          "create NAME",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		fs := cmd.Flags()
+		err := normalizeAutoscalingFlags(fs)
+		if err != nil {
+			return err
+		}
+		autoscaling, err := getAutoscaling(fs)
+		if err != nil {
+			return err
+		}
+		npArgs, err := getNodePoolArgs(ctx, fs)
+		if err != nil {
+			return err
+		}
+		defer npArgs.client.Close()
+		machineType, _ := fs.GetString("machine-type")
+		diskSize, _ := fs.GetInt32("disk-size")
+		numNodes, _ := fs.GetInt32("num-nodes")
+		nodeVersion, _ := fs.GetString("node-version")
+		req := &containerpb.CreateNodePoolRequest{
+			Parent: npArgs.clusterPath,
+			NodePool: &containerpb.NodePool{
+				Name: args[0],
+				Config: &containerpb.NodeConfig{
+					MachineType: machineType,
+					DiskSizeGb:  diskSize,
+				},
+				InitialNodeCount: numNodes,
+				Version:          nodeVersion,
+				Autoscaling:      autoscaling,
+			},
+		}
+		op, err := npArgs.client.CreateNodePool(ctx, req)
+		if err != nil {
+			return fmt.Errorf("unable to create node pool %s: %w", args[0], err)
+		}
+		return finishOperation(ctx, cmd, npArgs.client, npArgs.project, op)
+	},
+}
+
+var nodePoolsDeleteCmd = &cobra.Command{
+	Use:          "delete NAME",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		npArgs, err := getNodePoolArgs(ctx, cmd.Flags())
+		if err != nil {
+			return err
+		}
+		defer npArgs.client.Close()
+		gName := npArgs.nodePoolPath(args[0])
+		err = confirm(cmd, fmt.Sprintf("The node pool %s will be deleted.", gName))
+		if err != nil {
+			return err
+		}
+		op, err := npArgs.client.DeleteNodePool(ctx, &containerpb.DeleteNodePoolRequest{Name: gName})
+		if err != nil {
+			return fmt.Errorf("unable to delete node pool %s: %w", args[0], err)
+		}
+		return finishOperation(ctx, cmd, npArgs.client, npArgs.project, op)
+	},
+}
+
+var nodePoolsUpdateCmd = &cobra.Command{
+	Use:          "update NAME",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		fs := cmd.Flags()
+		err := normalizeAutoscalingFlags(fs)
+		if err != nil {
+			return err
+		}
+		autoscaling, err := getAutoscaling(fs)
+		if err != nil {
+			return err
+		}
+		if autoscaling == nil {
+			return errors.New("nothing to update, use --enable-autoscaling or --no-enable-autoscaling")
+		}
+		npArgs, err := getNodePoolArgs(ctx, fs)
+		if err != nil {
+			return err
+		}
+		defer npArgs.client.Close()
+		req := &containerpb.SetNodePoolAutoscalingRequest{
+			Name:        npArgs.nodePoolPath(args[0]),
+			Autoscaling: autoscaling,
+		}
+		op, err := npArgs.client.SetNodePoolAutoscaling(ctx, req)
+		if err != nil {
+			return fmt.Errorf("unable to update node pool %s: %w", args[0], err)
+		}
+		return finishOperation(ctx, cmd, npArgs.client, npArgs.project, op)
+	},
+}
+
+func registerNodePoolsCmd(parent *cobra.Command) {
+	// node pools have many more options than we implement
+	nodePoolsCmd.SetFlagErrorFunc(helpers.FallbackOnUnknownFlag)
+	nodePoolsCmd.PersistentFlags().String("cluster", "", "cluster of the node pools (default is the container/cluster property)")
+	helpers.AddFormatFlags(nodePoolsListCmd.Flags(), true)
+	nodePoolsCmd.AddCommand(nodePoolsListCmd)
+	helpers.AddFormatFlags(nodePoolsDescribeCmd.Flags(), false)
+	nodePoolsCmd.AddCommand(nodePoolsDescribeCmd)
+
+	fs := nodePoolsCreateCmd.Flags()
+	fs.String("machine-type", "e2-medium", "machine type of the nodes")
+	fs.Int32("disk-size", 100, "boot disk size of the nodes in GB")
+	fs.Int32("num-nodes", 3, "initial number of nodes per zone")
+	fs.String("node-version", "", "kubernetes version of the nodes (default is the master version)")
+	addAutoscalingFlags(fs)
+	addAsyncFlag(nodePoolsCreateCmd)
+	nodePoolsCmd.AddCommand(nodePoolsCreateCmd)
+
+	nodePoolsDeleteCmd.Flags().BoolP("quiet", "q", false, "do not prompt for confirmation")
+	addAsyncFlag(nodePoolsDeleteCmd)
+	nodePoolsCmd.AddCommand(nodePoolsDeleteCmd)
+
+	addAutoscalingFlags(nodePoolsUpdateCmd.Flags())
+	addAsyncFlag(nodePoolsUpdateCmd)
+	nodePoolsCmd.AddCommand(nodePoolsUpdateCmd)
+	parent.AddCommand(nodePoolsCmd)
+}
@@ -0,0 +1,80 @@
+package container
+
+import (
+	"io"
+	"testing"
+
+	"github.com/gartnera/gcloud/helpers"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+)
+
+func TestGetAutoscaling(t *testing.T) {
+	tests := []struct {
+		args    []string
+		want    *containerpb.NodePoolAutoscaling
+		wantErr bool
+	}{
+		{nil, nil, false},
+		{[]string{"--enable-autoscaling", "--min-nodes=1", "--max-nodes=5"}, &containerpb.NodePoolAutoscaling{Enabled: true, MinNodeCount: 1, MaxNodeCount: 5}, false},
+		{[]string{"--enable-autoscaling", "--max-nodes=3"}, &containerpb.NodePoolAutoscaling{Enabled: true, MaxNodeCount: 3}, false},
+		{[]string{"--no-enable-autoscaling"}, &containerpb.NodePoolAutoscaling{}, false},
+		{[]string{"--enable-autoscaling=false"}, &containerpb.NodePoolAutoscaling{}, false},
+		{[]string{"--enable-autoscaling"}, nil, true},
+		{[]string{"--enable-autoscaling", "--min-nodes=5", "--max-nodes=3"}, nil, true},
+		{[]string{"--enable-autoscaling", "--min-nodes=-1", "--max-nodes=3"}, nil, true},
+		{[]string{"--enable-autoscaling", "--max-nodes=0"}, nil, true},
+		{[]string{"--max-nodes=3"}, nil, true},
+		{[]string{"--enable-autoscaling", "--no-enable-autoscaling"}, nil, true},
+	}
+	for _, tt := range tests {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		addAutoscalingFlags(fs)
+		require.NoError(t, fs.Parse(tt.args))
+		err := normalizeAutoscalingFlags(fs)
+		var autoscaling *containerpb.NodePoolAutoscaling
+		if err == nil {
+			autoscaling, err = getAutoscaling(fs)
+		}
+		if tt.wantErr {
+			require.Error(t, err, "%v", tt.args)
+			continue
+		}
+		require.NoError(t, err, "%v", tt.args)
+		require.Equal(t, tt.want, autoscaling, "%v", tt.args)
+	}
+}
+
+func TestNormalizeAutoscalingFlags(t *testing.T) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	addAutoscalingFlags(fs)
+	require.NoError(t, fs.Parse([]string{"--no-enable-autoscaling"}))
+	require.NoError(t, normalizeAutoscalingFlags(fs))
+	require.True(t, fs.Changed("enable-autoscaling"))
+	enabled, _ := fs.GetBool("enable-autoscaling")
+	require.False(t, enabled)
+
+	fs = pflag.NewFlagSet("test", pflag.ContinueOnError)
+	addAutoscalingFlags(fs)
+	require.NoError(t, fs.Parse(nil))
+	require.NoError(t, normalizeAutoscalingFlags(fs))
+	require.False(t, fs.Changed("enable-autoscaling"))
+}
+
+func TestUnknownFlagFallback(t *testing.T) {
+	tests := [][]string{
+		{"node-pools", "create", "pool", "--cluster=prod", "--spot"},
+		{"node-pools", "create", "pool", "--cluster=prod", "--node-labels=env=prod"},
+		{"node-pools", "update", "pool", "--cluster=prod", "--node-locations=us-central1-a"},
+		{"clusters", "resize", "prod", "--num-nodes=3", "--node-locations=us-central1-a"},
+		{"clusters", "upgrade", "prod", "--image-type=COS_CONTAINERD"},
+	}
+	cmd := GetRootCmd()
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	for _, args := range tests {
+		cmd.SetArgs(args)
+		require.Equal(t, helpers.ErrFallback, cmd.Execute(), "%v", args)
+	}
+}
@@ -0,0 +1,282 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	container "cloud.google.com/go/container/apiv1"
+	"github.com/gartnera/gcloud/helpers"
+	"github.com/spf13/cobra"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// operationPollInterval is how often we check on long running operations
+const operationPollInterval = 3 * time.Second
+
+var operationsCmd = &cobra.Command{
+	Use: "operations",
+}
+
+var operationColumns = []helpers.Column{
+	{Path: "name"},
+	{Path: "operationType", Label: "TYPE"},
+	{Path: "location"},
+	{Path: "targetLink", Label: "TARGET"},
+	{Path: "statusMessage"},
+	{Path: "status"},
+	{Path: "startTime"},
+	{Path: "endTime"},
+}
+
+// operationPath returns the full resource name of the operation. If the location
+// is not known, it is discovered by searching for the operation in all locations.
+// A location from the compute properties is tried first, in which case the
+// operation fetched to check it is returned as well (otherwise it is nil).
+func (a *commonArgs) operationPath(ctx context.Context, client *container.ClusterManagerClient, operationID string) (string, *containerpb.Operation, error) {
+	if a.locationFromProperty {
+		gName := fmt.Sprintf("projects/%s/locations/%s/operations/%s", a.project, a.location, operationID)
+		op, err := client.GetOperation(ctx, &containerpb.GetOperationRequest{Name: gName})
+		if err == nil {
+			return gName, op, nil
+		}
+		if status.Code(err) != codes.NotFound {
+			return "", nil, fmt.Errorf("unable to get operation %s: %w", operationID, err)
+		}
+		a.location = ""
+		a.locationFromProperty = false
+	}
+	if a.location == "" {
+		req := &containerpb.ListOperationsRequest{
+			Parent: fmt.Sprintf("projects/%s/locations/-", a.project),
+		}
+		res, err := client.ListOperations(ctx, req)
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to list operations: %w", err)
+		}
+		for _, op := range res.Operations {
+			if op.Name == operationID {
+				a.location = op.Location
+				break
+			}
+		}
+		if a.location == "" {
+			return "", nil, fmt.Errorf("operation %s not found in project %s, use --location to specify the location", operationID, a.project)
+		}
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/operations/%s", a.project, a.location, operationID), nil, nil
+}
+
+// operationTarget returns the short name of the resource an operation acts on
+func operationTarget(op *containerpb.Operation) string {
+	target := op.TargetLink
+	if i := strings.Index(target, "/projects/"); i >= 0 {
+		target = target[i+1:]
+	}
+	return target
+}
+
+// operationProgress summarizes the progress metrics of an operation, e.g.
+// "NODES_DONE=3 NODES_TOTAL=12"
+func operationProgress(op *containerpb.Operation) string {
+	progress := op.GetProgress()
+	if progress == nil {
+		return ""
+	}
+	// report on the stage which is currently running if there is one
+	for _, stage := range progress.Stages {
+		if stage.Status == containerpb.Operation_RUNNING {
+			progress = stage
+			break
+		}
+	}
+	var parts []string
+	if progress.Name != "" {
+		parts = append(parts, progress.Name)
+	}
+	for _, metric := range progress.Metrics {
+		var value interface{}
+		switch v := metric.Value.(type) {
+		case *containerpb.OperationProgress_Metric_IntValue:
+			value = v.IntValue
+		case *containerpb.OperationProgress_Metric_DoubleValue:
+			value = v.DoubleValue
+		case *containerpb.OperationProgress_Metric_StringValue:
+			value = v.StringValue
+		}
+		parts = append(parts, fmt.Sprintf("%s=%v", metric.Name, value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// waitOperation polls the operation until it is done, printing progress to stderr
+func waitOperation(ctx context.Context, cmd *cobra.Command, client *container.ClusterManagerClient, project string, op *containerpb.Operation) (*containerpb.Operation, error) {
+	name := fmt.Sprintf("projects/%s/locations/%s/operations/%s", project, op.Location, op.Name)
+	fmt.Fprintf(cmd.ErrOrStderr(), "Waiting for %s of %s (%s)\n", op.OperationType, operationTarget(op), op.Name)
+	lastProgress := ""
+	for op.Status != containerpb.Operation_DONE {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(operationPollInterval):
+		}
+		var err error
+		op, err = client.GetOperation(ctx, &containerpb.GetOperationRequest{Name: name})
+		if err != nil {
+			return nil, fmt.Errorf("unable to get operation %s: %w", name, err)
+		}
+		if progress := operationProgress(op); progress != "" && progress != lastProgress {
+			fmt.Fprintf(cmd.ErrOrStderr(), "  %s\n", progress)
+			lastProgress = progress
+		}
+	}
+	if op.GetError().GetMessage() != "" {
+		return op, fmt.Errorf("operation %s failed: %s", op.Name, op.GetError().GetMessage())
+	}
+	if op.StatusMessage != "" {
+		return op, fmt.Errorf("operation %s failed: %s", op.Name, op.StatusMessage)
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Operation %s done\n", op.Name)
+	return op, nil
+}
+
+// finishOperation waits for the operation unless --async is set
+func finishOperation(ctx context.Context, cmd *cobra.Command, client *container.ClusterManagerClient, project string, op *containerpb.Operation) error {
+	if async, _ := cmd.Flags().GetBool("async"); async {
+		fmt.Fprintf(cmd.ErrOrStderr(), "Started %s of %s, check its status with: operations describe %s --location=%s\n", op.OperationType, operationTarget(op), op.Name, op.Location)
+		return nil
+	}
+	_, err := waitOperation(ctx, cmd, client, project, op)
+	return err
+}
+
+func addAsyncFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("async", false, "return immediately without waiting for the operation to complete")
+}
+
+var operationsListCmd = &cobra.Command{
+	Use:          "list",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		cFlags, err := getCommonFlags(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		client, _, err := newClusterManagerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		req := &containerpb.ListOperationsRequest{
+			Parent: cFlags.listParent(),
+		}
+		res, err := client.ListOperations(ctx, req)
+		if err != nil {
+			return fmt.Errorf("unable to list operations: %w", err)
+		}
+		if len(res.MissingZones) > 0 {
+			fmt.Fprintf(cmd.ErrOrStderr(), "WARNING: the following locations did not respond: %s\n", strings.Join(res.MissingZones, ", "))
+		}
+		var resources []helpers.Resource
+		for _, op := range res.Operations {
+			resource, err := helpers.ToResource(op)
+			if err != nil {
+				return err
+			}
+			resource["targetLink"] = operationTarget(op)
+			resources = append(resources, resource)
+		}
+		return helpers.PrintResources(cmd, resources, operationColumns)
+	},
+}
+
+// getOperation returns the operation named by the command arguments
+func getOperation(cmd *cobra.Command, args []string) (*container.ClusterManagerClient, *commonArgs, *containerpb.Operation, error) {
+	ctx := cmd.Context()
+	cFlags, err := getCommonFlags(cmd.Flags())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client, _, err := newClusterManagerClient(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	gName, op, err := cFlags.operationPath(ctx, client, args[0])
+	if err != nil {
+		client.Close()
+		return nil, nil, nil, err
+	}
+	if op == nil {
+		op, err = client.GetOperation(ctx, &containerpb.GetOperationRequest{Name: gName})
+		if err != nil {
+			client.Close()
+			return nil, nil, nil, fmt.Errorf("unable to get operation %s: %w", args[0], err)
+		}
+	}
+	return client, cFlags, op, nil
+}
+
+var operationsDescribeCmd = &cobra.Command{
+	Use:          "describe OPERATION_ID",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, _, op, err := getOperation(cmd, args)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		resource, err := helpers.ToResource(op)
+		if err != nil {
+			return err
+		}
+		return helpers.PrintResource(cmd, resource)
+	},
+}
+
+var operationsWaitCmd = &cobra.Command{
+	Use:          "wait OPERATION_ID",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, cFlags, op, err := getOperation(cmd, args)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		_, err = waitOperation(cmd.Context(), cmd, client, cFlags.project, op)
+		return err
+	},
+}
+
+var errOperationAborted = errors.New("aborted")
+
+// confirm asks the user to confirm a destructive change unless --quiet is set
+func confirm(cmd *cobra.Command, message string) error {
+	if quiet, _ := cmd.Flags().GetBool("quiet"); quiet {
+		return nil
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "%s\nDo you want to continue (y/N)? ", message)
+	var answer string
+	_, _ = fmt.Fscanln(cmd.InOrStdin(), &answer)
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		return errOperationAborted
+	}
+	return nil
+}
+
+func registerOperationsCmd(parent *cobra.Command) {
+	helpers.AddFormatFlags(operationsListCmd.Flags(), true)
+	operationsCmd.AddCommand(operationsListCmd)
+	helpers.AddFormatFlags(operationsDescribeCmd.Flags(), false)
+	operationsCmd.AddCommand(operationsDescribeCmd)
+	operationsCmd.AddCommand(operationsWaitCmd)
+	parent.AddCommand(operationsCmd)
+}
@@ -0,0 +1,160 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+)
+
+func TestConfirm(t *testing.T) {
+	tests := []struct {
+		args    []string
+		input   string
+		wantErr error
+	}{
+		{nil, "y\n", nil},
+		{nil, "YES\n", nil},
+		{nil, "n\n", errOperationAborted},
+		{nil, "\n", errOperationAborted},
+		{nil, "", errOperationAborted},
+		{[]string{"--quiet"}, "", nil},
+	}
+	for _, tt := range tests {
+		cmd := &cobra.Command{}
+		cmd.Flags().BoolP("quiet", "q", false, "")
+		require.NoError(t, cmd.ParseFlags(tt.args))
+		stderr := new(bytes.Buffer)
+		cmd.SetIn(strings.NewReader(tt.input))
+		cmd.SetErr(stderr)
+		err := confirm(cmd, "The node pool will be deleted.")
+		require.Equal(t, tt.wantErr, err, "%v %q", tt.args, tt.input)
+		if tt.args == nil {
+			require.Contains(t, stderr.String(), "The node pool will be deleted.")
+		} else {
+			require.Empty(t, stderr.String())
+		}
+	}
+}
+
+func TestOperationProgress(t *testing.T) {
+	tests := []struct {
+		progress *containerpb.OperationProgress
+		want     string
+	}{
+		{nil, ""},
+		{
+			&containerpb.OperationProgress{
+				Metrics: []*containerpb.OperationProgress_Metric{
+					{Name: "NODES_DONE", Value: &containerpb.OperationProgress_Metric_IntValue{IntValue: 3}},
+					{Name: "NODES_TOTAL", Value: &containerpb.OperationProgress_Metric_IntValue{IntValue: 12}},
+				},
+			},
+			"NODES_DONE=3 NODES_TOTAL=12",
+		},
+		{
+			// the running stage is reported
+			&containerpb.OperationProgress{
+				Name: "upgrade",
+				Stages: []*containerpb.OperationProgress{
+					{Name: "control-plane", Status: containerpb.Operation_DONE},
+					{
+						Name:   "nodes",
+						Status: containerpb.Operation_RUNNING,
+						Metrics: []*containerpb.OperationProgress_Metric{
+							{Name: "RATIO", Value: &containerpb.OperationProgress_Metric_DoubleValue{DoubleValue: 0.5}},
+							{Name: "POOL", Value: &containerpb.OperationProgress_Metric_StringValue{StringValue: "default"}},
+						},
+					},
+				},
+			},
+			"nodes RATIO=0.5 POOL=default",
+		},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, operationProgress(&containerpb.Operation{Progress: tt.progress}))
+	}
+}
+
+func TestFinishOperationAsync(t *testing.T) {
+	cmd := &cobra.Command{}
+	addAsyncFlag(cmd)
+	require.NoError(t, cmd.ParseFlags([]string{"--async"}))
+	stderr := new(bytes.Buffer)
+	cmd.SetErr(stderr)
+	op := &containerpb.Operation{
+		Name:          "operation-123",
+		OperationType: containerpb.Operation_SET_NODE_POOL_SIZE,
+		Location:      "us-central1",
+		TargetLink:    "https://container.googleapis.com/v1/projects/my-project/locations/us-central1/clusters/prod/nodePools/default",
+	}
+	// the operation isn't waited on, so no client is needed
+	err := finishOperation(context.Background(), cmd, nil, "my-project", op)
+	require.NoError(t, err)
+	require.Equal(t, "Started SET_NODE_POOL_SIZE of projects/my-project/locations/us-central1/clusters/prod/nodePools/default, check its status with: operations describe operation-123 --location=us-central1\n", stderr.String())
+}
+
+func TestOperationPath(t *testing.T) {
+	server := &fakeClusterManager{
+		operations: []*containerpb.Operation{
+			{Name: "operation-1", Location: "us-central1"},
+			{Name: "operation-2", Location: "us-west1-b"},
+		},
+	}
+	client := newFakeClusterManagerClient(t, server)
+	ctx := context.Background()
+	tests := []struct {
+		args     commonArgs
+		id       string
+		want     string
+		fetched  bool
+		requests []string
+		wantErr  bool
+	}{
+		{
+			commonArgs{project: "p", location: "us-east1"}, "operation-1",
+			"projects/p/locations/us-east1/operations/operation-1", false,
+			nil, false,
+		},
+		{
+			commonArgs{project: "p"}, "operation-2",
+			"projects/p/locations/us-west1-b/operations/operation-2", false,
+			[]string{"list projects/p/locations/-"}, false,
+		},
+		// the property location is right, so the operation is returned
+		{
+			commonArgs{project: "p", location: "us-central1", locationFromProperty: true}, "operation-1",
+			"projects/p/locations/us-central1/operations/operation-1", true,
+			[]string{"get projects/p/locations/us-central1/operations/operation-1"}, false,
+		},
+		// the operation is somewhere else
+		{
+			commonArgs{project: "p", location: "us-central1", locationFromProperty: true}, "operation-2",
+			"projects/p/locations/us-west1-b/operations/operation-2", false,
+			[]string{"get projects/p/locations/us-central1/operations/operation-2", "list projects/p/locations/-"}, false,
+		},
+		{
+			commonArgs{project: "p", location: "us-central1", locationFromProperty: true}, "missing",
+			"", false, nil, true,
+		},
+	}
+	for _, tt := range tests {
+		server.lock.Lock()
+		server.requests = nil
+		server.lock.Unlock()
+		args := tt.args
+		gName, op, err := args.operationPath(ctx, client, tt.id)
+		if tt.wantErr {
+			require.Error(t, err, tt.id)
+			continue
+		}
+		require.NoError(t, err, tt.id)
+		require.Equal(t, tt.want, gName)
+		require.Equal(t, tt.fetched, op != nil, tt.id)
+		require.Equal(t, tt.requests, server.requests, tt.id)
+	}
+}
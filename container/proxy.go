@@ -0,0 +1,426 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gartnera/gcloud/auth"
+	"github.com/gartnera/gcloud/compute/iap"
+	"github.com/gartnera/gcloud/helpers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+)
+
+// iapProxyArgs describe how kubectl reaches a private control plane. kubectl
+// talks to gcloud container proxy, which tunnels each connection with IAP TCP
+// forwarding, either to an http proxy on a bastion instance or directly to the
+// private endpoint through a destination group.
+type iapProxyArgs struct {
+	project string
+	// instance, zone, and port select the http proxy on a bastion
+	instance string
+	zone     string
+	port     int
+	// destGroup, region, and network select the destination group which
+	// contains the private endpoint
+	destGroup string
+	region    string
+	network   string
+	localPort int
+}
+
+// proxyURL is the kubeconfig proxy-url which points at gcloud container proxy
+func (a *iapProxyArgs) proxyURL() string {
+	return fmt.Sprintf("http://localhost:%d", a.localPort)
+}
+
+// proxyCommand is the command which serves proxyURL
+func (a *iapProxyArgs) proxyCommand() string {
+	if a.destGroup != "" {
+		return fmt.Sprintf("gcloud container proxy --project=%s --dest-group=%s --region=%s --network=%s --local-port=%d", a.project, a.destGroup, a.region, a.network, a.localPort)
+	}
+	return fmt.Sprintf("gcloud container proxy --project=%s --instance=%s --zone=%s --remote-port=%d --local-port=%d", a.project, a.instance, a.zone, a.port, a.localPort)
+}
+
+// locationRegion returns the region of a zone or region
+func locationRegion(location string) string {
+	// zones are the region with a -a, -b, ... suffix
+	if parts := strings.Split(location, "-"); len(parts) == 3 {
+		return parts[0] + "-" + parts[1]
+	}
+	return location
+}
+
+// getIapProxyArgs reads the --via-iap-bastion and --via-iap-dest-group flags.
+// It returns nil if neither is used.
+func getIapProxyArgs(fs *pflag.FlagSet, project string, cluster *containerpb.Cluster) (*iapProxyArgs, error) {
+	instance, _ := fs.GetString("via-iap-bastion")
+	destGroup, _ := fs.GetString("via-iap-dest-group")
+	if instance == "" && destGroup == "" {
+		return nil, nil
+	}
+	if instance != "" && destGroup != "" {
+		return nil, errors.New("only one of --via-iap-bastion or --via-iap-dest-group may be set")
+	}
+	localPort, _ := fs.GetInt("proxy-port")
+	if destGroup != "" {
+		// the destination group is in the region and network of the private endpoint
+		return &iapProxyArgs{
+			project:   project,
+			destGroup: destGroup,
+			region:    locationRegion(cluster.Location),
+			network:   cluster.Network,
+			localPort: localPort,
+		}, nil
+	}
+	zone, _ := fs.GetString("iap-bastion-zone")
+	if zone == "" {
+		zone = helpers.GetProperty("compute", "zone")
+	}
+	if zone == "" {
+		return nil, errors.New("--iap-bastion-zone is required (or set the compute/zone property)")
+	}
+	port, _ := fs.GetInt("iap-bastion-port")
+	return &iapProxyArgs{
+		project:   project,
+		instance:  instance,
+		zone:      zone,
+		port:      port,
+		localPort: localPort,
+	}, nil
+}
+
+func addIapProxyFlags(fs *pflag.FlagSet) {
+	fs.String("via-iap-bastion", "", "reach the control plane through an http proxy on this instance using IAP TCP forwarding (implies --internal-ip)")
+	fs.String("iap-bastion-zone", "", "zone of the bastion instance (default is the compute/zone property)")
+	fs.Int("iap-bastion-port", 8888, "port of the http proxy on the bastion instance")
+	fs.String("via-iap-dest-group", "", "reach the private endpoint directly using IAP TCP forwarding to this destination group, which must contain it (implies --internal-ip)")
+	fs.Int("proxy-port", 8888, "local port of gcloud container proxy written to the kubeconfig proxy-url")
+}
+
+// proxyDialFunc opens a connection to address (host:port)
+type proxyDialFunc func(ctx context.Context, address string) (io.ReadWriteCloser, error)
+
+// bufferedConn reads from a bufio.Reader which may hold data read from the connection
+type bufferedConn struct {
+	io.ReadWriteCloser
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// connectThroughProxy asks the http proxy at the other end of conn to connect to address
+func connectThroughProxy(conn io.ReadWriteCloser, address string) (io.ReadWriteCloser, error) {
+	_, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", address, address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to send connect request: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read connect response: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused to connect to %s: %s", address, res.Status)
+	}
+	return &bufferedConn{ReadWriteCloser: conn, reader: reader}, nil
+}
+
+// bastionDialer connects through the http proxy which m tunnels to
+func bastionDialer(m iap.TunnelManager) proxyDialFunc {
+	return func(ctx context.Context, address string) (io.ReadWriteCloser, error) {
+		tunnel, err := m.StartTunnel(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := connectThroughProxy(tunnel, address)
+		if err != nil {
+			tunnel.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// destGroupDialer tunnels to the host in the destination group selected by m
+func destGroupDialer(m iap.TunnelManager) proxyDialFunc {
+	return func(ctx context.Context, address string) (io.ReadWriteCloser, error) {
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s", portStr)
+		}
+		m.Host = host
+		m.RemotePort = port
+		return m.StartTunnel(ctx)
+	}
+}
+
+// proxyServer is a local HTTP CONNECT and SOCKS5 proxy which opens connections with dial
+type proxyServer struct {
+	dial   proxyDialFunc
+	errors io.Writer
+}
+
+// Serve handles each connection accepted on lis until ctx is done. lis is
+// closed and all connections are closed when Serve returns.
+func (p *proxyServer) Serve(ctx context.Context, lis net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	defer lis.Close()
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+	}()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("unable to accept: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.handleConn(ctx, conn)
+		}()
+	}
+}
+
+const socksVersion = 5
+
+// SOCKS5 reply codes from RFC 1928
+const (
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksCommandNotSupported = 7
+	socksAddressNotSupported = 8
+)
+
+var errSocksUnsupported = errors.New("unsupported socks request")
+
+// readSocksRequest negotiates no authentication and reads a CONNECT request
+func readSocksRequest(reader *bufio.Reader, conn io.Writer) (string, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return "", err
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(reader, methods)
+	if err != nil {
+		return "", err
+	}
+	if !strings.ContainsRune(string(methods), 0) {
+		_, _ = conn.Write([]byte{socksVersion, 0xff})
+		return "", errors.New("socks client does not support connecting without authentication")
+	}
+	_, err = conn.Write([]byte{socksVersion, 0})
+	if err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	_, err = io.ReadFull(reader, request)
+	if err != nil {
+		return "", err
+	}
+	if request[1] != 1 {
+		_ = writeSocksReply(conn, socksCommandNotSupported)
+		return "", errSocksUnsupported
+	}
+	var host string
+	switch request[3] {
+	case 1, 4:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == 4 {
+			ip = make([]byte, net.IPv6len)
+		}
+		_, err = io.ReadFull(reader, ip)
+		host = net.IP(ip).String()
+	case 3:
+		var length byte
+		length, err = reader.ReadByte()
+		if err == nil {
+			name := make([]byte, length)
+			_, err = io.ReadFull(reader, name)
+			host = string(name)
+		}
+	default:
+		_ = writeSocksReply(conn, socksAddressNotSupported)
+		return "", errSocksUnsupported
+	}
+	if err != nil {
+		return "", err
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(reader, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func writeSocksReply(conn io.Writer, reply byte) error {
+	// the bound address is not meaningful for a tunnel
+	_, err := conn.Write([]byte{socksVersion, reply, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// readConnectRequest reads an http CONNECT request
+func readConnectRequest(reader *bufio.Reader, conn io.Writer) (string, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return "", err
+	}
+	if req.Method != http.MethodConnect {
+		_, _ = io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\nContent-Length: 0\r\n\r\n")
+		return "", fmt.Errorf("unsupported method %s, only CONNECT is supported", req.Method)
+	}
+	return req.Host, nil
+}
+
+// handleConn reads the proxy request, then copies between conn and the target
+func (p *proxyServer) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	version, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	socks := version[0] == socksVersion
+	var address string
+	if socks {
+		address, err = readSocksRequest(reader, conn)
+	} else {
+		address, err = readConnectRequest(reader, conn)
+	}
+	if err != nil {
+		fmt.Fprintf(p.errors, "invalid proxy request: %s\n", err)
+		return
+	}
+
+	target, err := p.dial(ctx, address)
+	if socks {
+		reply := byte(socksSucceeded)
+		if err != nil {
+			reply = socksGeneralFailure
+		}
+		_ = writeSocksReply(conn, reply)
+	} else if err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+	} else {
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	}
+	if err != nil {
+		fmt.Fprintf(p.errors, "unable to connect to %s: %s\n", address, err)
+		return
+	}
+	defer target.Close()
+	go func() {
+		// anything the client sent after the request is already buffered in reader.
+		// Once the client is done writing, keep reading until the target is done.
+		_, _ = io.Copy(target, reader)
+	}()
+	_, err = io.Copy(conn, target)
+	if err != nil && ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+		fmt.Fprintf(p.errors, "connection to %s failed: %s\n", address, err)
+	}
+}
+
+// proxyCmd serves a local http and socks5 proxy for kubectl. Connections are
+// tunneled with IAP TCP forwarding, either through an http proxy on a bastion
+// instance or directly to a host in a destination group.
+var proxyCmd = &cobra.Command{
+	Use:          "proxy",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fs := cmd.Flags()
+		cFlags, err := getCommonFlags(fs)
+		if err != nil {
+			return err
+		}
+		instance, _ := fs.GetString("instance")
+		destGroup, _ := fs.GetString("dest-group")
+		if (instance == "") == (destGroup == "") {
+			return errors.New("one of --instance or --dest-group is required")
+		}
+		localPort, _ := fs.GetInt("local-port")
+		ts, err := auth.TokenSource()
+		if err != nil {
+			return fmt.Errorf("unable to get token source: %w", err)
+		}
+		tlsConfig, err := auth.ClientTLSConfig()
+		if err != nil {
+			return err
+		}
+		m := iap.TunnelManager{
+			Project:     cFlags.project,
+			TokenSource: ts,
+			TLSConfig:   tlsConfig,
+		}
+
+		server := &proxyServer{errors: cmd.ErrOrStderr()}
+		if destGroup != "" {
+			region, _ := fs.GetString("region")
+			network, _ := fs.GetString("network")
+			if region == "" || network == "" {
+				return errors.New("--region and --network are required with --dest-group")
+			}
+			m.Region = region
+			m.Network = network
+			m.DestGroup = destGroup
+			server.dial = destGroupDialer(m)
+			fmt.Fprintf(cmd.ErrOrStderr(), "Listening on localhost:%d, connecting through destination group %s\n", localPort, destGroup)
+		} else {
+			zone, _ := fs.GetString("zone")
+			if zone == "" {
+				zone = helpers.GetProperty("compute", "zone")
+			}
+			if zone == "" {
+				return errors.New("--zone is required (or set the compute/zone property)")
+			}
+			m.Zone = zone
+			m.Instance = instance
+			m.Interface = "nic0"
+			m.RemotePort, _ = fs.GetInt("remote-port")
+			server.dial = bastionDialer(m)
+			fmt.Fprintf(cmd.ErrOrStderr(), "Listening on localhost:%d, connecting through the proxy on %s:%d\n", localPort, instance, m.RemotePort)
+		}
+		lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", localPort))
+		if err != nil {
+			return fmt.Errorf("unable to listen: %w", err)
+		}
+		return server.Serve(cmd.Context(), lis)
+	},
+}
+
+func registerProxyCmd(parent *cobra.Command) {
+	fs := proxyCmd.Flags()
+	fs.String("instance", "", "bastion instance running an http proxy")
+	fs.Int("remote-port", 8888, "port of the http proxy on the bastion instance")
+	fs.String("dest-group", "", "destination group to connect to the targets directly (requires --region and --network)")
+	fs.String("network", "", "VPC network of the destination group")
+	fs.Int("local-port", 8888, "local port to listen on")
+	parent.AddCommand(proxyCmd)
+}
@@ -0,0 +1,230 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocationRegion(t *testing.T) {
+	require.Equal(t, "us-central1", locationRegion("us-central1"))
+	require.Equal(t, "us-central1", locationRegion("us-central1-a"))
+	require.Equal(t, "northamerica-northeast1", locationRegion("northamerica-northeast1-b"))
+}
+
+// serveTCP accepts connections on a local port and handles each with handle
+func serveTCP(t *testing.T, handle func(conn net.Conn)) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		lis.Close()
+	})
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+// startProxyServer serves a proxyServer which connects to target for every
+// request. The requested addresses are sent to the returned channel.
+func startProxyServer(t *testing.T, target string) (string, chan string) {
+	requested := make(chan string, 10)
+	server := &proxyServer{
+		dial: func(ctx context.Context, address string) (io.ReadWriteCloser, error) {
+			requested <- address
+			if target == "" {
+				return nil, errors.New("unreachable")
+			}
+			return net.Dial("tcp", target)
+		},
+		errors: io.Discard,
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = server.Serve(ctx, lis)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return lis.Addr().String(), requested
+}
+
+// replyHello reads a hello request and replies to it. Like an HTTP/1.0 server, it
+// closes the connection after replying.
+func replyHello(conn net.Conn) {
+	data := make([]byte, len("hello"))
+	_, _ = io.ReadFull(conn, data)
+	_, _ = conn.Write(append([]byte("got "), data...))
+}
+
+func TestProxyServerConnect(t *testing.T) {
+	address, requested := startProxyServer(t, serveTCP(t, replyHello))
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	// the data is sent along with the request, like clients which don't wait for the response
+	_, err = io.WriteString(conn, "CONNECT 10.0.0.2:443 HTTP/1.1\r\nHost: 10.0.0.2:443\r\n\r\nhello")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	// the response still arrives after the client is done writing
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "got hello", string(data))
+	require.Equal(t, "10.0.0.2:443", <-requested)
+}
+
+func TestProxyServerConnectFailed(t *testing.T) {
+	address, _ := startProxyServer(t, "")
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT 10.0.0.2:443 HTTP/1.1\r\nHost: 10.0.0.2:443\r\n\r\n")
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+
+	conn, err = net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET http://10.0.0.2/ HTTP/1.1\r\nHost: 10.0.0.2\r\n\r\n")
+	require.NoError(t, err)
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+// socksRequest is a SOCKS5 greeting offering no authentication and a CONNECT request
+func socksRequest(addressType byte, address []byte, port uint16) []byte {
+	request := []byte{5, 1, 0, 5, 1, 0, addressType}
+	if addressType == 3 {
+		request = append(request, byte(len(address)))
+	}
+	request = append(request, address...)
+	return append(request, byte(port>>8), byte(port))
+}
+
+func TestProxyServerSocks(t *testing.T) {
+	tests := []struct {
+		addressType byte
+		address     []byte
+		want        string
+	}{
+		{1, []byte{10, 0, 0, 2}, "10.0.0.2:443"},
+		{3, []byte("gke-1234.us-central1.gke.goog"), "gke-1234.us-central1.gke.goog:443"},
+		{4, net.ParseIP("fd00::2"), "[fd00::2]:443"},
+	}
+	for _, tt := range tests {
+		address, requested := startProxyServer(t, serveTCP(t, replyHello))
+		conn, err := net.Dial("tcp", address)
+		require.NoError(t, err)
+		_, err = conn.Write(append(socksRequest(tt.addressType, tt.address, 443), "hello"...))
+		require.NoError(t, err)
+		reply := make([]byte, 12)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+		require.Equal(t, []byte{5, 0}, reply[:2], tt.want)
+		require.Equal(t, []byte{5, 0, 0, 1}, reply[2:6], tt.want)
+		require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+		data, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "got hello", string(data))
+		require.Equal(t, tt.want, <-requested)
+		conn.Close()
+	}
+}
+
+func TestProxyServerSocksFailed(t *testing.T) {
+	address, _ := startProxyServer(t, "")
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(socksRequest(1, []byte{10, 0, 0, 2}, 443))
+	require.NoError(t, err)
+	reply := make([]byte, 12)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, byte(socksGeneralFailure), reply[3])
+
+	// only connecting without authentication is supported
+	conn, err = net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte{5, 1, 2})
+	require.NoError(t, err)
+	reply = make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5, 0xff}, reply)
+}
+
+// fakeHTTPProxy accepts CONNECT requests to allowed and echoes the connection
+func fakeHTTPProxy(allowed string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect || req.Host != allowed {
+			_, _ = io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		// data right after the response must not get lost
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nwelcome ")
+		_, _ = io.Copy(conn, reader)
+	}
+}
+
+func TestConnectThroughProxy(t *testing.T) {
+	address := serveTCP(t, fakeHTTPProxy("10.0.0.2:443"))
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	tunnel, err := connectThroughProxy(conn, "10.0.0.2:443")
+	require.NoError(t, err)
+	defer tunnel.Close()
+	_, err = io.WriteString(tunnel, "hello")
+	require.NoError(t, err)
+	data := make([]byte, len("welcome hello"))
+	_, err = io.ReadFull(tunnel, data)
+	require.NoError(t, err)
+	require.Equal(t, "welcome hello", string(data))
+
+	conn, err = net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = connectThroughProxy(conn, "10.0.0.3:443")
+	require.ErrorContains(t, err, "403")
+}
+
+func TestProxyCommand(t *testing.T) {
+	bastion := &iapProxyArgs{project: "p", instance: "bastion", zone: "us-central1-a", port: 8888, localPort: 8443}
+	require.Equal(t, "http://localhost:8443", bastion.proxyURL())
+	require.Equal(t, "gcloud container proxy --project=p --instance=bastion --zone=us-central1-a --remote-port=8888 --local-port=8443", bastion.proxyCommand())
+	direct := &iapProxyArgs{project: "p", destGroup: "gke", region: "us-central1", network: "default", localPort: 8443}
+	require.Equal(t, "gcloud container proxy --project=p --dest-group=gke --region=us-central1 --network=default --local-port=8443", direct.proxyCommand())
+}
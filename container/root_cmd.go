@@ -1,10 +1,20 @@
 package container
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"os"
+	"strings"
 
+	container "cloud.google.com/go/container/apiv1"
+	"github.com/gartnera/gcloud/auth"
+	"github.com/gartnera/gcloud/helpers"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var rootCmd = &cobra.Command{
@@ -17,10 +27,16 @@ func GetRootCmd() *cobra.Command {
 	if !rootCmdInitDone {
 		// setup common args
 		fs := rootCmd.PersistentFlags()
-		fs.String("project", "", "")
-		fs.String("region", "", "")
-		fs.String("zone", "", "")
+		fs.String("project", "", "project id (default is the core/project property)")
+		fs.String("location", "", "region or zone of the cluster")
+		fs.String("region", "", "region of the cluster (default is the compute/region property)")
+		fs.String("zone", "", "zone of the cluster (default is the compute/zone property)")
 		registerConfigHelperCmd(rootCmd)
+		registerNodePoolsCmd(rootCmd)
+		registerOperationsCmd(rootCmd)
+		registerVersionsCmd(rootCmd)
+		registerFleetCmd(rootCmd)
+		registerProxyCmd(rootCmd)
 		rootCmdInitDone = true
 	}
 	return rootCmd
@@ -28,26 +44,134 @@ func GetRootCmd() *cobra.Command {
 
 type commonArgs struct {
 	project string
-	region  string
-	zone    string
+	// location is a region or zone. It may be empty if it should be discovered.
+	location string
+	// locationFromProperty is set if location is the compute/region or
+	// compute/zone property, which is only a guess of where a cluster is
+	locationFromProperty bool
 }
 
 func getCommonFlags(fs *pflag.FlagSet) (*commonArgs, error) {
 	project, _ := fs.GetString("project")
 	if project == "" {
-		return nil, errors.New("--project is required")
+		project = helpers.GetProperty("core", "project")
 	}
+	if project == "" {
+		project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	if project == "" {
+		return nil, errors.New("--project is required (or set the core/project property)")
+	}
+	location, _ := fs.GetString("location")
 	region, _ := fs.GetString("region")
 	zone, _ := fs.GetString("zone")
-	if region == "" && zone == "" {
-		return nil, errors.New("either --project or --zone is required")
+	set := 0
+	for _, flagLocation := range []string{location, region, zone} {
+		if flagLocation != "" {
+			location = flagLocation
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("only one of --location, --region, or --zone may be set")
 	}
-	if region != "" && zone != "" {
-		return nil, errors.New("either --project or --zone is required")
+	locationFromProperty := false
+	if location == "" {
+		propRegion := helpers.GetProperty("compute", "region")
+		propZone := helpers.GetProperty("compute", "zone")
+		// if both are set we can't know which one is intended, so discover the location instead
+		if propRegion == "" || propZone == "" {
+			location = propRegion + propZone
+			locationFromProperty = location != ""
+		}
 	}
 	return &commonArgs{
-		project: project,
-		region:  region,
-		zone:    zone,
+		project:              project,
+		location:             location,
+		locationFromProperty: locationFromProperty,
 	}, nil
 }
+
+// listParent returns the parent to list resources in. This is all locations
+// unless the location was set explicitly, a location from the compute
+// properties is only a guess and would hide resources elsewhere.
+func (a *commonArgs) listParent() string {
+	location := a.location
+	if location == "" || a.locationFromProperty {
+		location = "-"
+	}
+	return fmt.Sprintf("projects/%s/locations/%s", a.project, location)
+}
+
+// clusterPath returns the full resource name of the cluster. If the location
+// is not known, it is discovered by searching for the cluster in all locations.
+// A location from the compute properties is tried first, in which case the
+// cluster fetched to check it is returned as well (otherwise it is nil).
+func (a *commonArgs) clusterPath(ctx context.Context, client *container.ClusterManagerClient, clusterName string) (string, *containerpb.Cluster, error) {
+	if a.locationFromProperty {
+		gName := fmt.Sprintf("projects/%s/locations/%s/clusters/%s", a.project, a.location, clusterName)
+		cluster, err := client.GetCluster(ctx, &containerpb.GetClusterRequest{Name: gName})
+		if err == nil {
+			return gName, cluster, nil
+		}
+		if status.Code(err) != codes.NotFound {
+			return "", nil, fmt.Errorf("unable to get cluster %s: %w", clusterName, err)
+		}
+		a.location = ""
+		a.locationFromProperty = false
+	}
+	if a.location == "" {
+		req := &containerpb.ListClustersRequest{
+			Parent: fmt.Sprintf("projects/%s/locations/-", a.project),
+		}
+		res, err := client.ListClusters(ctx, req)
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to list clusters: %w", err)
+		}
+		var candidates []string
+		for _, cluster := range res.Clusters {
+			if cluster.Name == clusterName {
+				candidates = append(candidates, cluster.Location)
+			}
+		}
+		if len(candidates) == 0 {
+			return "", nil, fmt.Errorf("cluster %s not found in project %s, use --location to specify the location", clusterName, a.project)
+		}
+		if len(candidates) > 1 {
+			return "", nil, fmt.Errorf("cluster %s exists in multiple locations (%s), use --location to pick one", clusterName, strings.Join(candidates, ", "))
+		}
+		a.location = candidates[0]
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/clusters/%s", a.project, a.location, clusterName), nil, nil
+}
+
+// getCluster returns the full resource name of the cluster along with the cluster
+func (a *commonArgs) getCluster(ctx context.Context, client *container.ClusterManagerClient, clusterName string) (string, *containerpb.Cluster, error) {
+	gName, cluster, err := a.clusterPath(ctx, client, clusterName)
+	if err != nil || cluster != nil {
+		return gName, cluster, err
+	}
+	cluster, err = client.GetCluster(ctx, &containerpb.GetClusterRequest{Name: gName})
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to get cluster %s: %w", clusterName, err)
+	}
+	return gName, cluster, nil
+}
+
+// newClusterManagerClient returns a container client along with the token source it uses
+func newClusterManagerClient(ctx context.Context) (*container.ClusterManagerClient, *auth.CachingTokenSource, error) {
+	// for whatever reason, option.WithTokenSource(auth.TokenSource()) does not work here
+	ts, err := auth.TokenSource()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get token source: %w", err)
+	}
+	opts, err := auth.ClientOptions(ts, "container.googleapis.com:443")
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := container.NewClusterManagerClient(ctx, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get container client: %w", err)
+	}
+	return client, ts, nil
+}
@@ -0,0 +1,244 @@
+package container
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	container "cloud.google.com/go/container/apiv1"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeClusterManager serves clusters from a fixed list
+type fakeClusterManager struct {
+	containerpb.UnimplementedClusterManagerServer
+	clusters   []*containerpb.Cluster
+	operations []*containerpb.Operation
+
+	lock     sync.Mutex
+	requests []string
+}
+
+func (s *fakeClusterManager) record(request string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, request)
+}
+
+func (s *fakeClusterManager) GetCluster(ctx context.Context, req *containerpb.GetClusterRequest) (*containerpb.Cluster, error) {
+	s.record("get " + req.Name)
+	for _, cluster := range s.clusters {
+		if strings.HasSuffix(req.Name, "/locations/"+cluster.Location+"/clusters/"+cluster.Name) {
+			return cluster, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "cluster %s not found", req.Name)
+}
+
+func (s *fakeClusterManager) ListClusters(ctx context.Context, req *containerpb.ListClustersRequest) (*containerpb.ListClustersResponse, error) {
+	s.record("list " + req.Parent)
+	return &containerpb.ListClustersResponse{Clusters: s.clusters}, nil
+}
+
+func (s *fakeClusterManager) GetOperation(ctx context.Context, req *containerpb.GetOperationRequest) (*containerpb.Operation, error) {
+	s.record("get " + req.Name)
+	for _, op := range s.operations {
+		if strings.HasSuffix(req.Name, "/locations/"+op.Location+"/operations/"+op.Name) {
+			return op, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "operation %s not found", req.Name)
+}
+
+func (s *fakeClusterManager) ListOperations(ctx context.Context, req *containerpb.ListOperationsRequest) (*containerpb.ListOperationsResponse, error) {
+	s.record("list " + req.Parent)
+	return &containerpb.ListOperationsResponse{Operations: s.operations}, nil
+}
+
+func newFakeClusterManagerClient(t *testing.T, server *fakeClusterManager) *container.ClusterManagerClient {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpc.NewServer()
+	containerpb.RegisterClusterManagerServer(grpcServer, server)
+	go func() {
+		_ = grpcServer.Serve(lis)
+	}()
+	t.Cleanup(grpcServer.Stop)
+	client, err := container.NewClusterManagerClient(context.Background(),
+		option.WithEndpoint(lis.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return client
+}
+
+func newCommonFlagSet() *pflag.FlagSet {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.String("project", "", "")
+	fs.String("location", "", "")
+	fs.String("region", "", "")
+	fs.String("zone", "", "")
+	return fs
+}
+
+func TestGetCommonFlags(t *testing.T) {
+	t.Setenv("CLOUDSDK_CONFIG", t.TempDir())
+	t.Setenv("CLOUDSDK_CORE_PROJECT", "my-project")
+	tests := []struct {
+		args         []string
+		propRegion   string
+		propZone     string
+		location     string
+		fromProperty bool
+		wantErr      bool
+	}{
+		{nil, "", "", "", false, false},
+		{[]string{"--region=us-central1"}, "", "", "us-central1", false, false},
+		{[]string{"--zone=us-central1-a"}, "us-west1", "", "us-central1-a", false, false},
+		{nil, "us-west1", "", "us-west1", true, false},
+		{nil, "", "us-west1-b", "us-west1-b", true, false},
+		{nil, "us-west1", "us-west1-b", "", false, false},
+		{[]string{"--region=us-central1", "--zone=us-central1-a"}, "", "", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("CLOUDSDK_COMPUTE_REGION", tt.propRegion)
+		t.Setenv("CLOUDSDK_COMPUTE_ZONE", tt.propZone)
+		fs := newCommonFlagSet()
+		require.NoError(t, fs.Parse(tt.args))
+		cFlags, err := getCommonFlags(fs)
+		if tt.wantErr {
+			require.Error(t, err, "%v", tt.args)
+			continue
+		}
+		require.NoError(t, err, "%v", tt.args)
+		require.Equal(t, "my-project", cFlags.project)
+		require.Equal(t, tt.location, cFlags.location, "%v %s %s", tt.args, tt.propRegion, tt.propZone)
+		require.Equal(t, tt.fromProperty, cFlags.locationFromProperty, "%v %s %s", tt.args, tt.propRegion, tt.propZone)
+	}
+}
+
+func TestListParent(t *testing.T) {
+	require.Equal(t, "projects/p/locations/-", (&commonArgs{project: "p"}).listParent())
+	require.Equal(t, "projects/p/locations/us-central1", (&commonArgs{project: "p", location: "us-central1"}).listParent())
+	require.Equal(t, "projects/p/locations/-", (&commonArgs{project: "p", location: "us-central1", locationFromProperty: true}).listParent())
+}
+
+func TestClusterPath(t *testing.T) {
+	server := &fakeClusterManager{
+		clusters: []*containerpb.Cluster{
+			{Name: "prod", Location: "us-central1"},
+			{Name: "dev", Location: "us-west1-b"},
+			{Name: "dup", Location: "us-west1"},
+			{Name: "dup", Location: "europe-west1"},
+		},
+	}
+	client := newFakeClusterManagerClient(t, server)
+	ctx := context.Background()
+	tests := []struct {
+		args     commonArgs
+		cluster  string
+		want     string
+		requests []string
+		wantErr  bool
+	}{
+		// an explicit location is used as is
+		{
+			commonArgs{project: "p", location: "us-east1"}, "prod",
+			"projects/p/locations/us-east1/clusters/prod",
+			nil, false,
+		},
+		{
+			commonArgs{project: "p"}, "dev",
+			"projects/p/locations/us-west1-b/clusters/dev",
+			[]string{"list projects/p/locations/-"}, false,
+		},
+		// the property location is right
+		{
+			commonArgs{project: "p", location: "us-central1", locationFromProperty: true}, "prod",
+			"projects/p/locations/us-central1/clusters/prod",
+			[]string{"get projects/p/locations/us-central1/clusters/prod"}, false,
+		},
+		// the cluster is somewhere else
+		{
+			commonArgs{project: "p", location: "us-central1", locationFromProperty: true}, "dev",
+			"projects/p/locations/us-west1-b/clusters/dev",
+			[]string{"get projects/p/locations/us-central1/clusters/dev", "list projects/p/locations/-"}, false,
+		},
+		{
+			commonArgs{project: "p", location: "us-central1", locationFromProperty: true}, "missing",
+			"", nil, true,
+		},
+		{
+			commonArgs{project: "p"}, "dup",
+			"", nil, true,
+		},
+	}
+	for _, tt := range tests {
+		server.lock.Lock()
+		server.requests = nil
+		server.lock.Unlock()
+		args := tt.args
+		gName, _, err := args.clusterPath(ctx, client, tt.cluster)
+		if tt.wantErr {
+			require.Error(t, err, tt.cluster)
+			continue
+		}
+		require.NoError(t, err, tt.cluster)
+		require.Equal(t, tt.want, gName)
+		require.Equal(t, tt.requests, server.requests, tt.cluster)
+	}
+}
+
+func TestGetCluster(t *testing.T) {
+	server := &fakeClusterManager{
+		clusters: []*containerpb.Cluster{
+			{Name: "prod", Location: "us-central1"},
+			{Name: "dev", Location: "us-west1-b"},
+		},
+	}
+	client := newFakeClusterManagerClient(t, server)
+	ctx := context.Background()
+	tests := []struct {
+		args     commonArgs
+		cluster  string
+		location string
+		requests []string
+	}{
+		// the cluster fetched to check the property location is reused
+		{
+			commonArgs{project: "p", location: "us-central1", locationFromProperty: true}, "prod", "us-central1",
+			[]string{"get projects/p/locations/us-central1/clusters/prod"},
+		},
+		{
+			commonArgs{project: "p", location: "us-central1", locationFromProperty: true}, "dev", "us-west1-b",
+			[]string{"get projects/p/locations/us-central1/clusters/dev", "list projects/p/locations/-", "get projects/p/locations/us-west1-b/clusters/dev"},
+		},
+		{
+			commonArgs{project: "p", location: "us-central1"}, "prod", "us-central1",
+			[]string{"get projects/p/locations/us-central1/clusters/prod"},
+		},
+	}
+	for _, tt := range tests {
+		server.lock.Lock()
+		server.requests = nil
+		server.lock.Unlock()
+		args := tt.args
+		_, cluster, err := args.getCluster(ctx, client, tt.cluster)
+		require.NoError(t, err, tt.cluster)
+		require.Equal(t, tt.cluster, cluster.Name)
+		require.Equal(t, tt.location, cluster.Location)
+		require.Equal(t, tt.requests, server.requests, tt.cluster)
+	}
+}
@@ -0,0 +1,262 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gartnera/gcloud/helpers"
+	"github.com/spf13/cobra"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+)
+
+// maxMinorSkew is the number of minor versions nodes may lag behind the control plane
+const maxMinorSkew = 2
+
+const (
+	findingVersionSkew        = "VERSION_SKEW"
+	findingEndOfSupport       = "END_OF_SUPPORT"
+	findingEndOfSupportSoon   = "END_OF_SUPPORT_SOON"
+	findingAutoUpgradePending = "AUTO_UPGRADE_PENDING"
+)
+
+// parseVersion splits a GKE version like 1.27.3-gke.100 into its numeric parts
+func parseVersion(version string) []int {
+	var parts []int
+	for _, field := range strings.FieldsFunc(version, func(r rune) bool { return r < '0' || r > '9' }) {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// compareVersions returns -1, 0, or 1 if a is older, the same, or newer than b
+func compareVersions(a string, b string) int {
+	aParts := parseVersion(a)
+	bParts := parseVersion(b)
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if aParts[i] != bParts[i] {
+			if aParts[i] < bParts[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(aParts) < len(bParts):
+		return -1
+	case len(aParts) > len(bParts):
+		return 1
+	}
+	return 0
+}
+
+// minorVersion returns the minor version (27 for 1.27.3-gke.100) or -1 if it can't be parsed
+func minorVersion(version string) int {
+	parts := parseVersion(version)
+	if len(parts) < 2 {
+		return -1
+	}
+	return parts[1]
+}
+
+// channelConfig returns the default and valid master versions for the release channel
+func channelConfig(serverConfig *containerpb.ServerConfig, channel containerpb.ReleaseChannel_Channel) (string, []string) {
+	for _, channelConfig := range serverConfig.Channels {
+		if channel != containerpb.ReleaseChannel_UNSPECIFIED && channelConfig.Channel == channel {
+			return channelConfig.DefaultVersion, channelConfig.ValidVersions
+		}
+	}
+	return serverConfig.DefaultClusterVersion, serverConfig.ValidMasterVersions
+}
+
+// checkClusterVersions reports on the control plane and each node pool of the cluster.
+// The API does not expose end of support dates, so a minor version is considered to
+// be nearing end of support once it is the oldest one still offered for new masters.
+func checkClusterVersions(cluster *containerpb.Cluster, serverConfig *containerpb.ServerConfig) []helpers.Resource {
+	channel := cluster.GetReleaseChannel().GetChannel()
+	defaultVersion, validVersions := channelConfig(serverConfig, channel)
+	oldestMinor := -1
+	for _, version := range validVersions {
+		if minor := minorVersion(version); minor >= 0 && (oldestMinor < 0 || minor < oldestMinor) {
+			oldestMinor = minor
+		}
+	}
+	supportFindings := func(version string) []interface{} {
+		minor := minorVersion(version)
+		switch {
+		case oldestMinor < 0 || minor < 0:
+			return []interface{}{}
+		case minor < oldestMinor:
+			return []interface{}{findingEndOfSupport}
+		case minor == oldestMinor:
+			return []interface{}{findingEndOfSupportSoon}
+		}
+		return []interface{}{}
+	}
+	channelName := "NONE"
+	if channel != containerpb.ReleaseChannel_UNSPECIFIED {
+		channelName = channel.String()
+	}
+	newRow := func(component string, version string, target string) helpers.Resource {
+		return helpers.Resource{
+			"cluster":        cluster.Name,
+			"location":       cluster.Location,
+			"channel":        channelName,
+			"component":      component,
+			"version":        version,
+			"defaultVersion": target,
+			"skew":           float64(0),
+			"pendingUpgrade": "",
+			"findings":       supportFindings(version),
+		}
+	}
+
+	masterVersion := cluster.CurrentMasterVersion
+	master := newRow("master", masterVersion, defaultVersion)
+	// masters are always upgraded to the default version eventually
+	if defaultVersion != "" && compareVersions(masterVersion, defaultVersion) < 0 {
+		master["pendingUpgrade"] = defaultVersion
+		master["findings"] = append(master["findings"].([]interface{}), findingAutoUpgradePending)
+	}
+	rows := []helpers.Resource{master}
+
+	masterMinor := minorVersion(masterVersion)
+	for _, nodePool := range cluster.NodePools {
+		row := newRow("nodePool/"+nodePool.Name, nodePool.Version, masterVersion)
+		findings := row["findings"].([]interface{})
+		if nodeMinor := minorVersion(nodePool.Version); masterMinor >= 0 && nodeMinor >= 0 {
+			skew := masterMinor - nodeMinor
+			row["skew"] = float64(skew)
+			if skew > maxMinorSkew {
+				findings = append(findings, findingVersionSkew)
+			}
+		}
+		if nodePool.GetManagement().GetAutoUpgrade() && compareVersions(nodePool.Version, masterVersion) < 0 {
+			row["pendingUpgrade"] = masterVersion
+			findings = append(findings, findingAutoUpgradePending)
+		}
+		row["findings"] = findings
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+var versionColumns = []helpers.Column{
+	{Path: "cluster"},
+	{Path: "location"},
+	{Path: "channel"},
+	{Path: "component"},
+	{Path: "version"},
+	{Path: "defaultVersion", Label: "TARGET_VERSION"},
+	{Path: "skew"},
+	{Path: "pendingUpgrade"},
+	{Path: "findings"},
+}
+
+var getServerConfigCmd = &cobra.Command{
+	Use:          "get-server-config",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		cFlags, err := getCommonFlags(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		if cFlags.location == "" {
+			return errors.New("--location, --region, or --zone is required")
+		}
+		client, _, err := newClusterManagerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		req := &containerpb.GetServerConfigRequest{
+			Name: fmt.Sprintf("projects/%s/locations/%s", cFlags.project, cFlags.location),
+		}
+		serverConfig, err := client.GetServerConfig(ctx, req)
+		if err != nil {
+			return fmt.Errorf("unable to get server config: %w", err)
+		}
+		resource, err := helpers.ToResource(serverConfig)
+		if err != nil {
+			return err
+		}
+		return helpers.PrintResource(cmd, resource)
+	},
+}
+
+var clustersCheckVersionsCmd = &cobra.Command{
+	Use:          "check-versions [NAME...]",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		cFlags, err := getCommonFlags(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		client, _, err := newClusterManagerClient(ctx)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		res, err := client.ListClusters(ctx, &containerpb.ListClustersRequest{
+			Parent: cFlags.listParent(),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to list clusters: %w", err)
+		}
+		if len(res.MissingZones) > 0 {
+			fmt.Fprintf(cmd.ErrOrStderr(), "WARNING: the following locations did not respond: %s\n", strings.Join(res.MissingZones, ", "))
+		}
+		names := map[string]bool{}
+		for _, name := range args {
+			names[name] = true
+		}
+
+		found := map[string]bool{}
+		serverConfigs := map[string]*containerpb.ServerConfig{}
+		var resources []helpers.Resource
+		for _, cluster := range res.Clusters {
+			if len(names) > 0 && !names[cluster.Name] {
+				continue
+			}
+			found[cluster.Name] = true
+			serverConfig, ok := serverConfigs[cluster.Location]
+			if !ok {
+				serverConfig, err = client.GetServerConfig(ctx, &containerpb.GetServerConfigRequest{
+					Name: fmt.Sprintf("projects/%s/locations/%s", cFlags.project, cluster.Location),
+				})
+				if err != nil {
+					return fmt.Errorf("unable to get server config for %s: %w", cluster.Location, err)
+				}
+				serverConfigs[cluster.Location] = serverConfig
+			}
+			resources = append(resources, checkClusterVersions(cluster, serverConfig)...)
+		}
+		var missing []string
+		for name := range names {
+			if !found[name] {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			return fmt.Errorf("clusters not found: %s", strings.Join(missing, ", "))
+		}
+		return helpers.PrintResources(cmd, resources, versionColumns)
+	},
+}
+
+func registerVersionsCmd(parent *cobra.Command) {
+	helpers.AddFormatFlags(getServerConfigCmd.Flags(), false)
+	parent.AddCommand(getServerConfigCmd)
+	helpers.AddFormatFlags(clustersCheckVersionsCmd.Flags(), true)
+	clustersCmd.AddCommand(clustersCheckVersionsCmd)
+}
@@ -0,0 +1,61 @@
+package container
+
+import (
+	"testing"
+
+	"github.com/gartnera/gcloud/helpers"
+	"github.com/stretchr/testify/require"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+)
+
+func TestCompareVersions(t *testing.T) {
+	require.Equal(t, -1, compareVersions("1.26.5-gke.1200", "1.27.3-gke.100"))
+	require.Equal(t, -1, compareVersions("1.27.3-gke.100", "1.27.3-gke.1000"))
+	require.Equal(t, 0, compareVersions("1.27.3-gke.100", "1.27.3-gke.100"))
+	require.Equal(t, 1, compareVersions("1.27.10-gke.1", "1.27.9-gke.1"))
+	require.Equal(t, 27, minorVersion("1.27.3-gke.100"))
+	require.Equal(t, -1, minorVersion("latest"))
+}
+
+func TestCheckClusterVersions(t *testing.T) {
+	serverConfig := &containerpb.ServerConfig{
+		DefaultClusterVersion: "1.27.3-gke.100",
+		ValidMasterVersions:   []string{"1.27.3-gke.100", "1.26.5-gke.1200", "1.25.10-gke.2700"},
+		Channels: []*containerpb.ServerConfig_ReleaseChannelConfig{
+			{
+				Channel:        containerpb.ReleaseChannel_REGULAR,
+				DefaultVersion: "1.27.3-gke.100",
+				ValidVersions:  []string{"1.27.3-gke.100", "1.26.5-gke.1200"},
+			},
+		},
+	}
+	cluster := &containerpb.Cluster{
+		Name:                 "prod",
+		Location:             "us-central1",
+		CurrentMasterVersion: "1.26.5-gke.1200",
+		ReleaseChannel:       &containerpb.ReleaseChannel{Channel: containerpb.ReleaseChannel_REGULAR},
+		NodePools: []*containerpb.NodePool{
+			{Name: "current", Version: "1.26.5-gke.1200", Management: &containerpb.NodeManagement{AutoUpgrade: true}},
+			{Name: "old", Version: "1.23.17-gke.300"},
+		},
+	}
+	rows := checkClusterVersions(cluster, serverConfig)
+	require.Len(t, rows, 3)
+
+	master := rows[0]
+	require.Equal(t, "REGULAR", master["channel"])
+	require.Equal(t, "1.27.3-gke.100", master["pendingUpgrade"])
+	require.Equal(t, []interface{}{findingEndOfSupportSoon, findingAutoUpgradePending}, master["findings"])
+
+	current := rows[1]
+	require.Equal(t, float64(0), current["skew"])
+	require.Equal(t, "", current["pendingUpgrade"])
+
+	old := rows[2]
+	require.Equal(t, float64(3), old["skew"])
+	require.Equal(t, []interface{}{findingEndOfSupport, findingVersionSkew}, old["findings"])
+
+	filtered, err := helpers.FilterResources(rows, "findings:VERSION_SKEW")
+	require.NoError(t, err)
+	require.Len(t, filtered, 1)
+}
@@ -1,6 +1,21 @@
 package helpers
 
-import "errors"
+import (
+	"errors"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
 
 var ErrFallback = errors.New("falling back to python gcloud")
 var ErrFallbackNoToken = errors.New("falling back to python gcloud with no token")
+
+// FallbackOnUnknownFlag is a cobra flag error func which falls back to python
+// gcloud when a flag we don't implement is used. Set it with
+// cmd.SetFlagErrorFunc, it applies to the subcommands as well.
+func FallbackOnUnknownFlag(cmd *cobra.Command, err error) error {
+	if strings.HasPrefix(err.Error(), "unknown flag") || strings.HasPrefix(err.Error(), "unknown shorthand flag") {
+		return ErrFallback
+	}
+	return err
+}
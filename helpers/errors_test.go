@@ -0,0 +1,34 @@
+package helpers
+
+import (
+	"io"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFallbackOnUnknownFlag(t *testing.T) {
+	tests := []struct {
+		args     []string
+		fallback bool
+	}{
+		{[]string{"--spot"}, true},
+		{[]string{"-x"}, true},
+		{[]string{"--num-nodes=three"}, false},
+	}
+	for _, tt := range tests {
+		cmd := &cobra.Command{
+			Use:  "test",
+			RunE: func(*cobra.Command, []string) error { return nil },
+		}
+		cmd.Flags().Int("num-nodes", 0, "")
+		cmd.SetFlagErrorFunc(FallbackOnUnknownFlag)
+		cmd.SetOut(io.Discard)
+		cmd.SetErr(io.Discard)
+		cmd.SetArgs(tt.args)
+		err := cmd.Execute()
+		require.Error(t, err, "%v", tt.args)
+		require.Equal(t, tt.fallback, err == ErrFallback, "%v: %v", tt.args, err)
+	}
+}
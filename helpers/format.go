@@ -0,0 +1,517 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// Resource is the generic representation of an API resource used for
+// formatting, filtering, and sorting. Keys are the camelCase API field names.
+type Resource = map[string]interface{}
+
+// Column is a column of table or value output
+type Column struct {
+	// Path is the dotted path to the field (ex: nodePools[0].config.machineType)
+	Path  string
+	Label string
+}
+
+// ToResource converts a proto message or json serializable value to a Resource
+func ToResource(v interface{}) (Resource, error) {
+	var jsonBytes []byte
+	var err error
+	if m, ok := v.(proto.Message); ok {
+		jsonBytes, err = protojson.Marshal(m)
+	} else {
+		jsonBytes, err = json.Marshal(v)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal resource: %w", err)
+	}
+	res := make(Resource)
+	err = json.Unmarshal(jsonBytes, &res)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal resource: %w", err)
+	}
+	return res, nil
+}
+
+// AddFormatFlags adds the gcloud style output flags. list adds flags that only make sense for lists.
+func AddFormatFlags(fs *pflag.FlagSet, list bool) {
+	fs.String("format", "", "output format: json, yaml, table(COLUMNS), or value(COLUMNS)")
+	if list {
+		fs.String("filter", "", "filter expression (ex: status=RUNNING location:us-)")
+		fs.Int("limit", 0, "maximum number of resources to print")
+		fs.String("sort-by", "", "comma separated fields to sort by, prefix with ~ to reverse")
+	}
+}
+
+var pathSegmentRe = regexp.MustCompile(`^([^\[]*)((?:\[\d+\])*)$`)
+var pathIndexRe = regexp.MustCompile(`\[(\d+)\]`)
+
+// Lookup returns the value at path or nil if it does not exist
+func Lookup(r Resource, path string) interface{} {
+	var current interface{} = r
+	for _, segment := range strings.Split(path, ".") {
+		match := pathSegmentRe.FindStringSubmatch(segment)
+		if match == nil {
+			return nil
+		}
+		if match[1] != "" {
+			m, ok := current.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			current = m[match[1]]
+		}
+		for _, indexMatch := range pathIndexRe.FindAllStringSubmatch(match[2], -1) {
+			index, _ := strconv.Atoi(indexMatch[1])
+			l, ok := current.([]interface{})
+			if !ok || index >= len(l) {
+				return nil
+			}
+			current = l[index]
+		}
+	}
+	return current
+}
+
+// FormatValue renders a value the way gcloud does in table and value output
+func FormatValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	case []interface{}:
+		var parts []string
+		for _, item := range t {
+			parts = append(parts, FormatValue(item))
+		}
+		return strings.Join(parts, ",")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var parts []string
+		for _, k := range keys {
+			parts = append(parts, fmt.Sprintf("%s=%s", k, FormatValue(t[k])))
+		}
+		return strings.Join(parts, ";")
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// parseColumns parses a column list like name,location:label=LOCATION
+func parseColumns(spec string) []Column {
+	var columns []Column
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		column := Column{Path: part}
+		if i := strings.Index(part, ":"); i >= 0 {
+			column.Path = part[:i]
+			for _, attr := range strings.Split(part[i+1:], ":") {
+				if strings.HasPrefix(attr, "label=") {
+					column.Label = strings.Trim(strings.TrimPrefix(attr, "label="), `"'`)
+				}
+			}
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+func columnLabel(column Column) string {
+	if column.Label != "" {
+		return column.Label
+	}
+	path := column.Path
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		path = path[i+1:]
+	}
+	path = pathIndexRe.ReplaceAllString(path, "")
+	// camelCase -> CAMEL_CASE
+	var sb strings.Builder
+	for i, r := range path {
+		if i > 0 && r >= 'A' && r <= 'Z' {
+			sb.WriteRune('_')
+		}
+		sb.WriteRune(r)
+	}
+	return strings.ToUpper(sb.String())
+}
+
+// splitFormat splits table(a,b) into table and a,b
+func splitFormat(format string) (string, string, error) {
+	i := strings.Index(format, "(")
+	if i < 0 {
+		return format, "", nil
+	}
+	if !strings.HasSuffix(format, ")") {
+		return "", "", fmt.Errorf("invalid format: %s", format)
+	}
+	return format[:i], format[i+1 : len(format)-1], nil
+}
+
+// parseFormat returns the kind and columns of a format. Formats we don't
+// implement (other kinds, attributes, projections of json and yaml, and column
+// transforms) return ErrFallback so python gcloud prints them instead.
+func parseFormat(format string, defaultColumns []Column) (string, []Column, error) {
+	kind, columnSpec, err := splitFormat(format)
+	if err != nil {
+		return "", nil, ErrFallback
+	}
+	if strings.Contains(columnSpec, "(") {
+		return "", nil, ErrFallback
+	}
+	columns := defaultColumns
+	if columnSpec != "" {
+		columns = parseColumns(columnSpec)
+	}
+	switch kind {
+	case "json", "yaml":
+		if columnSpec != "" {
+			return "", nil, ErrFallback
+		}
+	case "table", "value":
+		if len(columns) == 0 {
+			return "", nil, ErrFallback
+		}
+	default:
+		return "", nil, ErrFallback
+	}
+	return kind, columns, nil
+}
+
+func printTable(w io.Writer, resources []Resource, columns []Column) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	var labels []string
+	for _, column := range columns {
+		labels = append(labels, columnLabel(column))
+	}
+	fmt.Fprintln(tw, strings.Join(labels, "\t"))
+	for _, r := range resources {
+		var values []string
+		for _, column := range columns {
+			values = append(values, FormatValue(Lookup(r, column.Path)))
+		}
+		fmt.Fprintln(tw, strings.Join(values, "\t"))
+	}
+	return tw.Flush()
+}
+
+func printValues(w io.Writer, resources []Resource, columns []Column) {
+	for _, r := range resources {
+		var values []string
+		for _, column := range columns {
+			values = append(values, FormatValue(Lookup(r, column.Path)))
+		}
+		fmt.Fprintln(w, strings.Join(values, "\t"))
+	}
+}
+
+// printFormatted renders resources. If single is set, json and yaml output a
+// single document rather than a list.
+func printFormatted(w io.Writer, format string, resources []Resource, defaultColumns []Column, single bool) error {
+	kind, columns, err := parseFormat(format, defaultColumns)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if single && len(resources) == 1 {
+			return encoder.Encode(resources[0])
+		}
+		if resources == nil {
+			resources = []Resource{}
+		}
+		return encoder.Encode(resources)
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if single && len(resources) == 1 {
+			return encoder.Encode(resources[0])
+		}
+		for _, r := range resources {
+			err = encoder.Encode(r)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "table":
+		return printTable(w, resources, columns)
+	}
+	printValues(w, resources, columns)
+	return nil
+}
+
+// PrintResources prints a list of resources respecting the --format, --filter,
+// --limit, and --sort-by flags. The default format is a table of defaultColumns.
+func PrintResources(cmd *cobra.Command, resources []Resource, defaultColumns []Column) error {
+	fs := cmd.Flags()
+	format, _ := fs.GetString("format")
+	filter, _ := fs.GetString("filter")
+	limit, _ := fs.GetInt("limit")
+	sortBy, _ := fs.GetString("sort-by")
+	if format == "" {
+		format = "table"
+	}
+
+	resources, err := FilterResources(resources, filter)
+	if err != nil {
+		return err
+	}
+	if sortBy != "" {
+		SortResources(resources, strings.Split(sortBy, ","))
+	}
+	if limit > 0 && len(resources) > limit {
+		resources = resources[:limit]
+	}
+	return printFormatted(cmd.OutOrStdout(), format, resources, defaultColumns, false)
+}
+
+// CheckFormat returns ErrFallback if PrintResource can't print --format.
+// Commands that change resources call it first so that they don't fall back
+// to python gcloud after making the change.
+func CheckFormat(cmd *cobra.Command) error {
+	format, _ := cmd.Flags().GetString("format")
+	if format == "" {
+		return nil
+	}
+	_, _, err := parseFormat(format, nil)
+	return err
+}
+
+// PrintResource prints a single resource respecting --format. The default format is yaml.
+func PrintResource(cmd *cobra.Command, resource Resource) error {
+	format, _ := cmd.Flags().GetString("format")
+	if format == "" {
+		format = "yaml"
+	}
+	return printFormatted(cmd.OutOrStdout(), format, []Resource{resource}, nil, true)
+}
+
+func compareValues(a interface{}, b interface{}) int {
+	aStr := FormatValue(a)
+	bStr := FormatValue(b)
+	// int64 fields are strings in the json representation so compare numerically when possible
+	aNum, aErr := strconv.ParseFloat(aStr, 64)
+	bNum, bErr := strconv.ParseFloat(bStr, 64)
+	if aErr == nil && bErr == nil {
+		switch {
+		case aNum < bNum:
+			return -1
+		case aNum > bNum:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(aStr, bStr)
+}
+
+// SortResources sorts by the fields in order. Fields prefixed with ~ are sorted in reverse.
+func SortResources(resources []Resource, fields []string) {
+	sort.SliceStable(resources, func(i, j int) bool {
+		for _, field := range fields {
+			field = strings.TrimSpace(field)
+			reverse := strings.HasPrefix(field, "~")
+			field = strings.TrimPrefix(field, "~")
+			cmp := compareValues(Lookup(resources[i], field), Lookup(resources[j], field))
+			if cmp == 0 {
+				continue
+			}
+			if reverse {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+		return false
+	})
+}
+
+type filterTerm struct {
+	path   string
+	op     string
+	value  string
+	negate bool
+	re     *regexp.Regexp
+}
+
+// filterOps are the supported filter operators. The operator at the earliest
+// position of a term is used, and the longest one if several start there (>=
+// rather than >).
+var filterOps = []string{"!=", "!~", "<=", ">=", "=", ":", "~", "<", ">"}
+
+// splitFilter splits a filter into words respecting quotes
+func splitFilter(filter string) ([]string, error) {
+	var words []string
+	var sb strings.Builder
+	var quote rune
+	for _, r := range filter {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			sb.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ' ' || r == '\t':
+			if sb.Len() > 0 {
+				words = append(words, sb.String())
+				sb.Reset()
+			}
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	if quote != 0 {
+		return nil, ErrFallback
+	}
+	if sb.Len() > 0 {
+		words = append(words, sb.String())
+	}
+	return words, nil
+}
+
+func parseFilter(filter string) ([]filterTerm, error) {
+	words, err := splitFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var terms []filterTerm
+	negateNext := false
+	for _, word := range words {
+		if word == "AND" {
+			continue
+		}
+		// leave OR, grouping, and global restrictions to python gcloud
+		if word == "OR" || strings.ContainsAny(word, "()") {
+			return nil, ErrFallback
+		}
+		if word == "NOT" {
+			negateNext = true
+			continue
+		}
+		term := filterTerm{negate: negateNext}
+		negateNext = false
+		if strings.HasPrefix(word, "-") {
+			term.negate = true
+			word = strings.TrimPrefix(word, "-")
+		}
+		opIndex := -1
+		for _, op := range filterOps {
+			i := strings.Index(word, op)
+			if i <= 0 {
+				continue
+			}
+			if opIndex < 0 || i < opIndex || (i == opIndex && len(op) > len(term.op)) {
+				opIndex = i
+				term.op = op
+			}
+		}
+		if opIndex < 0 {
+			return nil, ErrFallback
+		}
+		term.path = word[:opIndex]
+		term.value = word[opIndex+len(term.op):]
+		if term.op == "~" || term.op == "!~" {
+			// python and go regexes differ, so let python gcloud handle what go can't parse
+			term.re, err = regexp.Compile(term.value)
+			if err != nil {
+				return nil, ErrFallback
+			}
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+func (t filterTerm) matchValue(v interface{}) bool {
+	if l, ok := v.([]interface{}); ok && t.op == ":" {
+		for _, item := range l {
+			if t.matchValue(item) {
+				return true
+			}
+		}
+		return false
+	}
+	str := FormatValue(v)
+	switch t.op {
+	case "=":
+		return strings.EqualFold(str, t.value)
+	case "!=":
+		return !strings.EqualFold(str, t.value)
+	case ":":
+		if t.value == "*" {
+			return str != ""
+		}
+		return strings.Contains(strings.ToLower(str), strings.ToLower(t.value))
+	case "~":
+		return t.re.MatchString(str)
+	case "!~":
+		return !t.re.MatchString(str)
+	case "<":
+		return compareValues(v, t.value) < 0
+	case "<=":
+		return compareValues(v, t.value) <= 0
+	case ">":
+		return compareValues(v, t.value) > 0
+	case ">=":
+		return compareValues(v, t.value) >= 0
+	}
+	return false
+}
+
+// FilterResources implements a subset of the gcloud filter language: space
+// (or AND) separated terms of the form key=value, key!=value, key:value (has),
+// key~regex, key!~regex, key<value, key<=value, key>value, and key>=value.
+// Terms can be negated with a - or NOT prefix. Other filters return
+// ErrFallback.
+func FilterResources(resources []Resource, filter string) ([]Resource, error) {
+	if strings.TrimSpace(filter) == "" {
+		return resources, nil
+	}
+	terms, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var res []Resource
+	for _, r := range resources {
+		matched := true
+		for _, term := range terms {
+			if term.matchValue(Lookup(r, term.path)) == term.negate {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			res = append(res, r)
+		}
+	}
+	return res, nil
+}
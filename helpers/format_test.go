@@ -0,0 +1,145 @@
+package helpers
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testResources() []Resource {
+	return []Resource{
+		{
+			"name":             "prod",
+			"location":         "us-central1",
+			"status":           "RUNNING",
+			"currentNodeCount": float64(12),
+			"nodePools":        []interface{}{map[string]interface{}{"config": map[string]interface{}{"machineType": "e2-standard-4"}}},
+		},
+		{
+			"name":             "dev",
+			"location":         "us-west1-c",
+			"status":           "RECONCILING",
+			"currentNodeCount": float64(3),
+		},
+	}
+}
+
+func TestLookup(t *testing.T) {
+	r := testResources()[0]
+	require.Equal(t, "e2-standard-4", Lookup(r, "nodePools[0].config.machineType"))
+	require.Nil(t, Lookup(r, "nodePools[1].config.machineType"))
+	require.Nil(t, Lookup(r, "missing.field"))
+}
+
+func TestFilterResources(t *testing.T) {
+	tests := []struct {
+		filter string
+		names  []string
+	}{
+		{"", []string{"prod", "dev"}},
+		{"status=running", []string{"prod"}},
+		{"location:us-west1", []string{"dev"}},
+		{"NOT status=RUNNING", []string{"dev"}},
+		{"-status=RUNNING", []string{"dev"}},
+		{"name~^p AND currentNodeCount>5", []string{"prod"}},
+		{"currentNodeCount<5", []string{"dev"}},
+		{"nodePools:*", []string{"prod"}},
+		{"currentNodeCount>=12", []string{"prod"}},
+		{"currentNodeCount>=13", nil},
+		{"currentNodeCount<=3", []string{"dev"}},
+		{"currentNodeCount<=2", nil},
+		{"status!=RUNNING", []string{"dev"}},
+		{"name!~^p", []string{"dev"}},
+		{"location=us-central1", []string{"prod"}},
+	}
+	for _, tt := range tests {
+		res, err := FilterResources(testResources(), tt.filter)
+		require.NoError(t, err, tt.filter)
+		var names []string
+		for _, r := range res {
+			names = append(names, r["name"].(string))
+		}
+		require.Equal(t, tt.names, names, tt.filter)
+	}
+
+	// unsupported syntax is left to python gcloud
+	for _, filter := range []string{
+		"name",
+		"status=RUNNING OR status=RECONCILING",
+		"(status=RUNNING)",
+		"name='prod",
+		"name~(?=p)",
+	} {
+		_, err := FilterResources(testResources(), filter)
+		require.Equal(t, ErrFallback, err, filter)
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		term  string
+		path  string
+		op    string
+		value string
+	}{
+		{"a=b", "a", "=", "b"},
+		{"a!=b", "a", "!=", "b"},
+		{"a>=b", "a", ">=", "b"},
+		{"a<=b", "a", "<=", "b"},
+		{"a>b", "a", ">", "b"},
+		{"a!~b", "a", "!~", "b"},
+		// the earliest operator wins, the rest is the value
+		{"a:b=c", "a", ":", "b=c"},
+		{"a=b>=c", "a", "=", "b>=c"},
+		{"labels.env~^prod-", "labels.env", "~", "^prod-"},
+	}
+	for _, tt := range tests {
+		terms, err := parseFilter(tt.term)
+		require.NoError(t, err, tt.term)
+		require.Len(t, terms, 1, tt.term)
+		require.Equal(t, tt.path, terms[0].path, tt.term)
+		require.Equal(t, tt.op, terms[0].op, tt.term)
+		require.Equal(t, tt.value, terms[0].value, tt.term)
+	}
+}
+
+func TestSortResources(t *testing.T) {
+	resources := testResources()
+	SortResources(resources, []string{"currentNodeCount"})
+	require.Equal(t, "dev", resources[0]["name"])
+	SortResources(resources, []string{"~currentNodeCount"})
+	require.Equal(t, "prod", resources[0]["name"])
+}
+
+func TestPrintFormatted(t *testing.T) {
+	columns := []Column{{Path: "name"}, {Path: "currentNodeCount", Label: "NUM_NODES"}}
+
+	buf := new(bytes.Buffer)
+	err := printFormatted(buf, "table", testResources(), columns, false)
+	require.NoError(t, err)
+	require.Equal(t, "NAME  NUM_NODES\nprod  12\ndev   3\n", buf.String())
+
+	buf.Reset()
+	err = printFormatted(buf, "value(name,nodePools[0].config.machineType)", testResources(), columns, false)
+	require.NoError(t, err)
+	require.Equal(t, "prod\te2-standard-4\ndev\t\n", buf.String())
+
+	buf.Reset()
+	err = printFormatted(buf, "table(name:label=CLUSTER,status)", testResources()[:1], columns, false)
+	require.NoError(t, err)
+	require.Equal(t, "CLUSTER  STATUS\nprod     RUNNING\n", buf.String())
+
+	for _, format := range []string{
+		"csv",
+		"table[box](name)",
+		"json(name)",
+		"value(name.basename())",
+		"table(name",
+	} {
+		err = printFormatted(buf, format, testResources(), columns, false)
+		require.Equal(t, ErrFallback, err, format)
+	}
+	err = printFormatted(buf, "table", testResources(), nil, true)
+	require.Equal(t, ErrFallback, err)
+}
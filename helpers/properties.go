@@ -0,0 +1,136 @@
+package helpers
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// propertySections are the property sections which may be set via
+// CLOUDSDK_SECTION_NAME environment variables
+var propertySections = []string{
+	"api_endpoints",
+	"auth",
+	"compute",
+	"container",
+	"context_aware",
+	"core",
+	"proxy",
+}
+
+// Properties are gcloud configuration properties keyed by section then name
+type Properties map[string]map[string]string
+
+// Get returns the property or an empty string if it is not set
+func (p Properties) Get(section string, name string) string {
+	return p[section][name]
+}
+
+func (p Properties) set(section string, name string, value string) {
+	if p[section] == nil {
+		p[section] = make(map[string]string)
+	}
+	p[section][name] = value
+}
+
+// ConfigDir returns the gcloud configuration directory
+func ConfigDir() string {
+	configDir := os.Getenv("CLOUDSDK_CONFIG")
+	if configDir == "" {
+		// TODO: cross platform
+		configDir = os.ExpandEnv("${HOME}/.config/gcloud")
+	}
+	return configDir
+}
+
+// ActiveConfigName returns the name of the active gcloud configuration
+func ActiveConfigName() string {
+	name := os.Getenv("CLOUDSDK_ACTIVE_CONFIG_NAME")
+	if name != "" {
+		return name
+	}
+	nameBytes, err := os.ReadFile(filepath.Join(ConfigDir(), "active_config"))
+	if err == nil {
+		name = strings.TrimSpace(string(nameBytes))
+	}
+	if name == "" {
+		name = "default"
+	}
+	return name
+}
+
+func parseProperties(path string, props Properties) error {
+	propsFile, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open properties: %w", err)
+	}
+	defer propsFile.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(propsFile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || section == "" {
+			continue
+		}
+		props.set(section, strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read properties: %w", err)
+	}
+	return nil
+}
+
+func applyEnvProperties(props Properties) {
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		key := strings.TrimPrefix(parts[0], "CLOUDSDK_")
+		if key == parts[0] || parts[1] == "" {
+			continue
+		}
+		for _, section := range propertySections {
+			prefix := strings.ToUpper(section) + "_"
+			if strings.HasPrefix(key, prefix) {
+				props.set(section, strings.ToLower(strings.TrimPrefix(key, prefix)), parts[1])
+				break
+			}
+		}
+	}
+}
+
+// LoadProperties loads the properties of the active gcloud configuration.
+// Environment variables (CLOUDSDK_CORE_PROJECT) take precedence over the
+// configuration file.
+func LoadProperties() (Properties, error) {
+	props := make(Properties)
+	configPath := filepath.Join(ConfigDir(), "configurations", "config_"+ActiveConfigName())
+	err := parseProperties(configPath, props)
+	if err != nil {
+		return nil, err
+	}
+	applyEnvProperties(props)
+	return props, nil
+}
+
+// GetProperty returns a single property of the active gcloud configuration
+// or an empty string if it is not set or cannot be loaded
+func GetProperty(section string, name string) string {
+	props, err := LoadProperties()
+	if err != nil {
+		return ""
+	}
+	return props.Get(section, name)
+}
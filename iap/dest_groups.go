@@ -0,0 +1,258 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gartnera/gcloud/auth"
+	"github.com/gartnera/gcloud/helpers"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	iap "google.golang.org/api/iap/v1"
+)
+
+var destGroupsCmd = &cobra.Command{
+	Use: "dest-groups",
+}
+
+var destGroupColumns = []helpers.Column{
+	{Path: "name"},
+	{Path: "region"},
+	{Path: "cidrs", Label: "IP_RANGES"},
+	{Path: "fqdns"},
+}
+
+// destGroupArgs are the resolved flags shared by the dest-groups commands
+type destGroupArgs struct {
+	svc     *iap.Service
+	project string
+	region  string
+}
+
+// parent is the resource name the destination groups of the region belong to
+func (a *destGroupArgs) parent() string {
+	return fmt.Sprintf("projects/%s/iap_tunnel/locations/%s", a.project, a.region)
+}
+
+func (a *destGroupArgs) destGroupPath(name string) string {
+	return fmt.Sprintf("%s/destGroups/%s", a.parent(), name)
+}
+
+func getDestGroupArgs(cmd *cobra.Command) (*destGroupArgs, error) {
+	fs := cmd.Flags()
+	project, _ := fs.GetString("project")
+	if project == "" {
+		project = helpers.GetProperty("core", "project")
+	}
+	if project == "" {
+		project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	if project == "" {
+		return nil, errors.New("--project is required (or set the core/project property)")
+	}
+	region, _ := fs.GetString("region")
+	if region == "" {
+		return nil, errors.New("--region is required")
+	}
+	ts, err := auth.TokenSource()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get token source: %w", err)
+	}
+	opts, err := auth.ClientOptions(ts, "https://iap.googleapis.com/")
+	if err != nil {
+		return nil, err
+	}
+	svc, err := iap.NewService(cmd.Context(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get iap client: %w", err)
+	}
+	return &destGroupArgs{
+		svc:     svc,
+		project: project,
+		region:  region,
+	}, nil
+}
+
+// destGroupResource converts a destination group to a resource with its short name
+func destGroupResource(group *iap.TunnelDestGroup, region string) (helpers.Resource, error) {
+	resource, err := helpers.ToResource(group)
+	if err != nil {
+		return nil, err
+	}
+	resource["name"] = group.Name[strings.LastIndex(group.Name, "/")+1:]
+	resource["region"] = region
+	return resource, nil
+}
+
+// appendCidrs appends the cidrs which are not in existing yet and reports whether any were added
+func appendCidrs(existing []string, cidrs []string) ([]string, bool) {
+	seen := map[string]bool{}
+	for _, cidr := range existing {
+		seen[cidr] = true
+	}
+	added := false
+	for _, cidr := range cidrs {
+		if !seen[cidr] {
+			seen[cidr] = true
+			existing = append(existing, cidr)
+			added = true
+		}
+	}
+	return existing, added
+}
+
+func listDestGroups(ctx context.Context, svc *iap.Service, parent string) ([]*iap.TunnelDestGroup, error) {
+	var groups []*iap.TunnelDestGroup
+	err := svc.Projects.IapTunnel.Locations.DestGroups.List(parent).Pages(ctx, func(res *iap.ListTunnelDestGroupsResponse) error {
+		groups = append(groups, res.TunnelDestGroups...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list destination groups: %w", err)
+	}
+	return groups, nil
+}
+
+func createDestGroup(ctx context.Context, svc *iap.Service, parent string, id string, cidrs []string, fqdns []string) (*iap.TunnelDestGroup, error) {
+	cidrs, _ = appendCidrs(nil, cidrs)
+	group := &iap.TunnelDestGroup{
+		Name:  fmt.Sprintf("%s/destGroups/%s", parent, id),
+		Cidrs: cidrs,
+		Fqdns: fqdns,
+	}
+	group, err := svc.Projects.IapTunnel.Locations.DestGroups.Create(parent, group).TunnelDestGroupId(id).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create destination group %s: %w", id, err)
+	}
+	return group, nil
+}
+
+// addDestGroupIps merges cidrs into the ip ranges of a destination group. Only the
+// ip ranges are patched so the fqdns are left alone.
+func addDestGroupIps(ctx context.Context, svc *iap.Service, name string, cidrs []string) (*iap.TunnelDestGroup, error) {
+	id := name[strings.LastIndex(name, "/")+1:]
+	group, err := svc.Projects.IapTunnel.Locations.DestGroups.Get(name).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get destination group %s: %w", id, err)
+	}
+	merged, added := appendCidrs(group.Cidrs, cidrs)
+	if !added {
+		return group, nil
+	}
+	patch := &iap.TunnelDestGroup{
+		Name:  name,
+		Cidrs: merged,
+	}
+	group, err = svc.Projects.IapTunnel.Locations.DestGroups.Patch(name, patch).UpdateMask("cidrs").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to update destination group %s: %w", id, err)
+	}
+	return group, nil
+}
+
+var destGroupsListCmd = &cobra.Command{
+	Use:          "list",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dArgs, err := getDestGroupArgs(cmd)
+		if err != nil {
+			return err
+		}
+		groups, err := listDestGroups(cmd.Context(), dArgs.svc, dArgs.parent())
+		if err != nil {
+			return err
+		}
+		var resources []helpers.Resource
+		for _, group := range groups {
+			resource, err := destGroupResource(group, dArgs.region)
+			if err != nil {
+				return err
+			}
+			resources = append(resources, resource)
+		}
+		return helpers.PrintResources(cmd, resources, destGroupColumns)
+	},
+}
+
+var destGroupsCreateCmd = &cobra.Command{
+	Use:          "create NAME",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := helpers.CheckFormat(cmd); err != nil {
+			return err
+		}
+		dArgs, err := getDestGroupArgs(cmd)
+		if err != nil {
+			return err
+		}
+		cidrs, _ := cmd.Flags().GetStringSlice("ip-range-list")
+		fqdns, _ := cmd.Flags().GetStringSlice("fqdn-list")
+		if len(cidrs) == 0 && len(fqdns) == 0 {
+			return errors.New("at least one of --ip-range-list or --fqdn-list is required")
+		}
+		group, err := createDestGroup(cmd.Context(), dArgs.svc, dArgs.parent(), args[0], cidrs, fqdns)
+		if err != nil {
+			return err
+		}
+		resource, err := destGroupResource(group, dArgs.region)
+		if err != nil {
+			return err
+		}
+		return helpers.PrintResource(cmd, resource)
+	},
+}
+
+// destGroupsAddIpsCmd adds ip ranges to a destination group, keeping the ones it already has
+var destGroupsAddIpsCmd = &cobra.Command{
+	Use:          "add-ips NAME",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		if err := helpers.CheckFormat(cmd); err != nil {
+			return err
+		}
+		dArgs, err := getDestGroupArgs(cmd)
+		if err != nil {
+			return err
+		}
+		cidrs, _ := cmd.Flags().GetStringSlice("ip-range-list")
+		if len(cidrs) == 0 {
+			return errors.New("--ip-range-list is required")
+		}
+		group, err := addDestGroupIps(ctx, dArgs.svc, dArgs.destGroupPath(args[0]), cidrs)
+		if err != nil {
+			return err
+		}
+		resource, err := destGroupResource(group, dArgs.region)
+		if err != nil {
+			return err
+		}
+		return helpers.PrintResource(cmd, resource)
+	},
+}
+
+func addRangeFlags(fs *pflag.FlagSet, fqdns bool) {
+	fs.StringSlice("ip-range-list", nil, "comma separated IP ranges (CIDR notation) of the hosts")
+	if fqdns {
+		fs.StringSlice("fqdn-list", nil, "comma separated FQDNs of the hosts")
+	}
+}
+
+func registerDestGroupsCmd(parent *cobra.Command) {
+	destGroupsCmd.PersistentFlags().String("region", "", "region of the destination groups")
+	helpers.AddFormatFlags(destGroupsListCmd.Flags(), true)
+	destGroupsCmd.AddCommand(destGroupsListCmd)
+	addRangeFlags(destGroupsCreateCmd.Flags(), true)
+	helpers.AddFormatFlags(destGroupsCreateCmd.Flags(), false)
+	destGroupsCmd.AddCommand(destGroupsCreateCmd)
+	addRangeFlags(destGroupsAddIpsCmd.Flags(), false)
+	helpers.AddFormatFlags(destGroupsAddIpsCmd.Flags(), false)
+	destGroupsCmd.AddCommand(destGroupsAddIpsCmd)
+	parent.AddCommand(destGroupsCmd)
+}
@@ -0,0 +1,214 @@
+package iap
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	iap "google.golang.org/api/iap/v1"
+	"google.golang.org/api/option"
+)
+
+const testParent = "projects/p/iap_tunnel/locations/us-central1"
+
+// fakeDestGroupRequest is a request received by the fake IAP API
+type fakeDestGroupRequest struct {
+	method     string
+	path       string
+	updateMask string
+	// fields are the fields set in the request body
+	fields []string
+}
+
+// newFakeIapService serves the destination groups of groups, which is modified by
+// create and patch requests
+func newFakeIapService(t *testing.T, groups map[string]*iap.TunnelDestGroup) (*iap.Service, *[]fakeDestGroupRequest) {
+	var requests []fakeDestGroupRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := strings.TrimPrefix(req.URL.Path, "/v1/")
+		request := fakeDestGroupRequest{
+			method:     req.Method,
+			path:       name,
+			updateMask: req.URL.Query().Get("updateMask"),
+		}
+		var body map[string]json.RawMessage
+		if req.Method == http.MethodPost || req.Method == http.MethodPatch {
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for field := range body {
+				request.fields = append(request.fields, field)
+			}
+			sort.Strings(request.fields)
+		}
+		requests = append(requests, request)
+
+		switch {
+		case req.Method == http.MethodGet && strings.HasSuffix(name, "/destGroups"):
+			res := &iap.ListTunnelDestGroupsResponse{}
+			for groupName, group := range groups {
+				if strings.HasPrefix(groupName, name+"/") {
+					res.TunnelDestGroups = append(res.TunnelDestGroups, group)
+				}
+			}
+			sort.Slice(res.TunnelDestGroups, func(i, j int) bool {
+				return res.TunnelDestGroups[i].Name < res.TunnelDestGroups[j].Name
+			})
+			_ = json.NewEncoder(w).Encode(res)
+			return
+		case req.Method == http.MethodPost:
+			group := &iap.TunnelDestGroup{}
+			_ = json.Unmarshal(mustMarshal(t, body), group)
+			group.Name = name + "/" + req.URL.Query().Get("tunnelDestGroupId")
+			if groups[group.Name] != nil {
+				http.Error(w, `{"error": {"code": 409, "message": "already exists"}}`, http.StatusConflict)
+				return
+			}
+			groups[group.Name] = group
+			_ = json.NewEncoder(w).Encode(group)
+			return
+		}
+		group := groups[name]
+		if group == nil {
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+			return
+		}
+		if req.Method == http.MethodPatch {
+			patch := &iap.TunnelDestGroup{}
+			_ = json.Unmarshal(mustMarshal(t, body), patch)
+			for _, field := range strings.Split(request.updateMask, ",") {
+				switch field {
+				case "cidrs":
+					group.Cidrs = patch.Cidrs
+				case "fqdns":
+					group.Fqdns = patch.Fqdns
+				}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(group)
+	}))
+	t.Cleanup(server.Close)
+	svc, err := iap.NewService(context.Background(), option.WithEndpoint(server.URL+"/"), option.WithHTTPClient(server.Client()))
+	require.NoError(t, err)
+	return svc, &requests
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return data
+}
+
+func TestListDestGroups(t *testing.T) {
+	svc, requests := newFakeIapService(t, map[string]*iap.TunnelDestGroup{
+		testParent + "/destGroups/gke":                               {Name: testParent + "/destGroups/gke", Cidrs: []string{"10.0.0.0/28"}},
+		testParent + "/destGroups/db":                                {Name: testParent + "/destGroups/db", Fqdns: []string{"db.internal"}},
+		"projects/p/iap_tunnel/locations/europe-west1/destGroups/eu": {Name: "projects/p/iap_tunnel/locations/europe-west1/destGroups/eu"},
+	})
+	groups, err := listDestGroups(context.Background(), svc, testParent)
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+	require.Equal(t, testParent+"/destGroups/db", groups[0].Name)
+	require.Equal(t, []string{"db.internal"}, groups[0].Fqdns)
+	require.Equal(t, testParent+"/destGroups/gke", groups[1].Name)
+	require.Equal(t, []fakeDestGroupRequest{{method: http.MethodGet, path: testParent + "/destGroups"}}, *requests)
+
+	resource, err := destGroupResource(groups[1], "us-central1")
+	require.NoError(t, err)
+	require.Equal(t, "gke", resource["name"])
+	require.Equal(t, "us-central1", resource["region"])
+}
+
+func TestCreateDestGroup(t *testing.T) {
+	groups := map[string]*iap.TunnelDestGroup{}
+	svc, requests := newFakeIapService(t, groups)
+	ctx := context.Background()
+	group, err := createDestGroup(ctx, svc, testParent, "gke", []string{"10.0.0.0/28", "10.0.1.0/28", "10.0.0.0/28"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, testParent+"/destGroups/gke", group.Name)
+	// duplicate ip ranges are only sent once
+	require.Equal(t, []string{"10.0.0.0/28", "10.0.1.0/28"}, groups[group.Name].Cidrs)
+	require.Equal(t, []fakeDestGroupRequest{
+		{method: http.MethodPost, path: testParent + "/destGroups", fields: []string{"cidrs", "name"}},
+	}, *requests)
+
+	_, err = createDestGroup(ctx, svc, testParent, "gke", []string{"10.0.2.0/28"}, nil)
+	require.ErrorContains(t, err, "unable to create destination group gke")
+}
+
+func TestAddDestGroupIps(t *testing.T) {
+	name := testParent + "/destGroups/gke"
+	tests := []struct {
+		desc     string
+		existing *iap.TunnelDestGroup
+		cidrs    []string
+		want     []string
+		patched  bool
+		wantErr  bool
+	}{
+		{
+			desc:     "empty group",
+			existing: &iap.TunnelDestGroup{Name: name},
+			cidrs:    []string{"10.0.0.0/28"},
+			want:     []string{"10.0.0.0/28"},
+			patched:  true,
+		},
+		{
+			desc:     "existing ranges are kept",
+			existing: &iap.TunnelDestGroup{Name: name, Cidrs: []string{"10.0.0.0/28"}, Fqdns: []string{"db.internal"}},
+			cidrs:    []string{"10.0.1.0/28"},
+			want:     []string{"10.0.0.0/28", "10.0.1.0/28"},
+			patched:  true,
+		},
+		{
+			desc:     "duplicate ranges",
+			existing: &iap.TunnelDestGroup{Name: name, Cidrs: []string{"10.0.0.0/28"}},
+			cidrs:    []string{"10.0.0.0/28", "10.0.1.0/28", "10.0.1.0/28"},
+			want:     []string{"10.0.0.0/28", "10.0.1.0/28"},
+			patched:  true,
+		},
+		{
+			desc:     "nothing to add",
+			existing: &iap.TunnelDestGroup{Name: name, Cidrs: []string{"10.0.0.0/28", "10.0.1.0/28"}},
+			cidrs:    []string{"10.0.1.0/28", "10.0.0.0/28"},
+			want:     []string{"10.0.0.0/28", "10.0.1.0/28"},
+		},
+		{
+			desc:    "missing group",
+			cidrs:   []string{"10.0.0.0/28"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			groups := map[string]*iap.TunnelDestGroup{}
+			var fqdns []string
+			if tt.existing != nil {
+				groups[name] = tt.existing
+				fqdns = tt.existing.Fqdns
+			}
+			svc, requests := newFakeIapService(t, groups)
+			group, err := addDestGroupIps(context.Background(), svc, name, tt.cidrs)
+			if tt.wantErr {
+				require.ErrorContains(t, err, "unable to get destination group gke")
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, group.Cidrs)
+			require.Equal(t, tt.want, groups[name].Cidrs)
+			require.Equal(t, fqdns, groups[name].Fqdns)
+			want := []fakeDestGroupRequest{{method: http.MethodGet, path: name}}
+			if tt.patched {
+				// only the ip ranges are updated
+				want = append(want, fakeDestGroupRequest{method: http.MethodPatch, path: name, updateMask: "cidrs", fields: []string{"cidrs", "name"}})
+			}
+			require.Equal(t, want, *requests)
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package iap
+
+import "github.com/spf13/cobra"
+
+var rootCmd = &cobra.Command{
+	Use: "iap",
+}
+
+var tcpCmd = &cobra.Command{
+	Use: "tcp",
+}
+
+var rootCmdInitDone = false
+
+func GetRootCmd() *cobra.Command {
+	if !rootCmdInitDone {
+		rootCmd.PersistentFlags().String("project", "", "project id (default is the core/project property)")
+		registerDestGroupsCmd(tcpCmd)
+		rootCmd.AddCommand(tcpCmd)
+		rootCmdInitDone = true
+	}
+	return rootCmd
+}
@@ -5,12 +5,16 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/gartnera/gcloud/auth"
+	"github.com/gartnera/gcloud/components"
+	"github.com/gartnera/gcloud/compute"
 	"github.com/gartnera/gcloud/config"
 	"github.com/gartnera/gcloud/container"
 	"github.com/gartnera/gcloud/helpers"
+	"github.com/gartnera/gcloud/iap"
 	"github.com/spf13/cobra"
 )
 
@@ -89,11 +93,37 @@ func maybeFallback() {
 	}
 }
 
+// getPluginCmd returns the plugin command matching the name we were invoked as
+// (busybox style) or nil if we were invoked as gcloud
+func getPluginCmd() *cobra.Command {
+	name := filepath.Base(os.Args[0])
+	// links on windows are called gke-gcloud-auth-plugin.exe
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	switch name {
+	case config.GkeAuthPluginName:
+		return config.GetGkeAuthPluginCmd()
+	case auth.DockerCredentialHelperName:
+		return auth.GetDockerCredentialHelperCmd()
+	}
+	return nil
+}
+
 func main() {
+	if pluginCmd := getPluginCmd(); pluginCmd != nil {
+		err := pluginCmd.Execute()
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	rootCmd.PersistentFlags().String("impersonate-service-account", "", "service account email to impersonate")
 	rootCmd.AddCommand(auth.GetRootCmd())
+	rootCmd.AddCommand(compute.GetRootCmd())
 	rootCmd.AddCommand(config.GetRootCmd())
 	rootCmd.AddCommand(container.GetRootCmd())
+	rootCmd.AddCommand(components.GetRootCmd())
+	rootCmd.AddCommand(iap.GetRootCmd())
 
 	// automatically fallback to google provided gcloud if we don't have a matching command
 	// fallback for unknown commands, root commands, and intermediate commands (commands that have multiple children)